@@ -0,0 +1,244 @@
+package rin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectActions represents actions for the source object after the import.
+// They run in order of tags and copy_to, and delete runs after the actions of all targets for the record.
+type ObjectActions struct {
+	Tags   map[string]string `yaml:"tags"`
+	CopyTo string            `yaml:"copy_to"`
+	Delete bool              `yaml:"delete"`
+}
+
+func (a *ObjectActions) validate(name string) error {
+	if a == nil {
+		return nil
+	}
+	if len(a.Tags) == 0 && a.CopyTo == "" && !a.Delete {
+		return fmt.Errorf("target.%s requires tags, copy_to or delete", name)
+	}
+	if strings.HasPrefix(a.CopyTo, "s3://") {
+		u, err := url.Parse(a.CopyTo)
+		if err != nil || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+			return fmt.Errorf("target.%s.copy_to must be s3://bucket/key or key", name)
+		}
+	}
+	return nil
+}
+
+func (t *Target) validateObjectActions() error {
+	if err := t.OnSuccess.validate("on_success"); err != nil {
+		return err
+	}
+	if err := t.OnFailure.validate("on_failure"); err != nil {
+		return err
+	}
+	if t.OnFailure != nil && t.OnFailure.Delete {
+		return fmt.Errorf("target.on_failure.delete is not allowed, because failed objects must be kept to be imported again")
+	}
+	if t.OnSuccess != nil && t.OnSuccess.Delete && t.OnRemove != nil {
+		return fmt.Errorf("target.on_success.delete and on_remove are exclusive, because on_remove deletes the imported rows of deleted objects")
+	}
+	for name, a := range map[string]*ObjectActions{"on_success": t.OnSuccess, "on_failure": t.OnFailure} {
+		if a == nil || a.CopyTo == "" {
+			continue
+		}
+		bucket, key, err := t.sampleCopyTo(a.CopyTo)
+		if err != nil {
+			return fmt.Errorf("target.%s.copy_to %s: %w", name, a.CopyTo, err)
+		}
+		if ok, _ := t.Match(bucket, key); ok {
+			return fmt.Errorf("target.%s.copy_to %s must not match the target itself, because copied objects are imported again", name, a.CopyTo)
+		}
+	}
+	return nil
+}
+
+var samplePlaceHolder = regexp.MustCompile(`\$\{[^}]*\}|\$[0-9]+`)
+
+// sampleCopyTo returns the destination of copy_to for a sample object of the target. Captured values and attributes are expanded to "rin".
+func (t *Target) sampleCopyTo(copyTo string) (string, string, error) {
+	bucket, key := t.S3.Bucket, t.S3.KeyPrefix+"rin"+t.S3.KeySuffix
+	dest := samplePlaceHolder.ReplaceAllStringFunc(copyTo, func(p string) string {
+		switch p {
+		case "${bucket}":
+			return bucket
+		case "${key}":
+			return key
+		}
+		return "rin"
+	})
+	return parseCopyTo(bucket, dest)
+}
+
+// parseCopyTo returns the bucket and the key of the expanded copy_to. A key without s3:// is in the bucket of the source object.
+func parseCopyTo(bucket, dest string) (string, string, error) {
+	if !strings.HasPrefix(dest, "s3://") {
+		return bucket, dest, nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+var objectPlaceHolders = []string{"${bucket}", "${key}", "${timestamp}"}
+
+// ExpandObjectTemplate expands captured values, ${bucket}, ${key}, ${timestamp} and the attributes of the record.
+func ExpandObjectTemplate(s string, record *EventRecord, capture *[]string, now time.Time) (string, error) {
+	values := []string{record.S3.Bucket.Name, record.S3.Object.Key, now.UTC().Format(time.RFC3339)}
+	for i, p := range objectPlaceHolders {
+		s = strings.Replace(s, p, values[i], -1)
+	}
+	return expandAttributes(expandPlaceHolder(s, capture), record.Attributes)
+}
+
+// runObjectActions runs the actions for the record. The errors are logged and not returned, because the import has been completed.
+func (r *Rin) runObjectActions(ctx context.Context, req *ImportRequest, actions *ObjectActions, name string) {
+	if actions == nil {
+		return
+	}
+	if err := r.doObjectActions(ctx, req, actions); err != nil {
+		r.logger.Printf("[error] [%s] %s actions for %s failed. %s", req.MessageID, name, req.Record, err)
+	}
+}
+
+// runSuccessActions runs on_success actions of the requests after all records of the event were imported.
+// Objects are deleted after the other actions of all targets, and they are kept when any action for them failed.
+func (r *Rin) runSuccessActions(ctx context.Context, reqs []*ImportRequest) {
+	failed := make(map[*EventRecord]bool)
+	for _, req := range reqs {
+		if err := r.doObjectActions(ctx, req, req.Target.OnSuccess); err != nil {
+			r.logger.Printf("[error] [%s] on_success actions for %s failed. %s", req.MessageID, req.Record, err)
+			failed[req.Record] = true
+		}
+	}
+	deleted := make(map[*EventRecord]bool)
+	for _, req := range reqs {
+		if !req.Target.OnSuccess.Delete || deleted[req.Record] {
+			continue
+		}
+		deleted[req.Record] = true
+		if failed[req.Record] {
+			r.logger.Printf("[warn] [%s] %s is not deleted because on_success actions failed", req.MessageID, req.Record)
+			continue
+		}
+		if err := r.deleteObject(ctx, req); err != nil {
+			r.logger.Printf("[error] [%s] on_success actions for %s failed. %s", req.MessageID, req.Record, err)
+		}
+	}
+}
+
+func s3OptFn(target *Target) func(*s3.Options) {
+	return func(o *s3.Options) {
+		if target.S3.Region != "" {
+			o.Region = target.S3.Region
+		}
+	}
+}
+
+// doObjectActions runs tags and copy_to of the actions. delete is run by runSuccessActions.
+func (r *Rin) doObjectActions(ctx context.Context, req *ImportRequest, actions *ObjectActions) error {
+	svc := r.getS3Client()
+	record := req.Record
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	optFn := s3OptFn(req.Target)
+	now := time.Now()
+
+	if len(actions.Tags) > 0 {
+		// PutObjectTagging replaces all tags, so merge them into the current tags
+		tags := map[string]string{}
+		if record.Attributes != nil && record.Attributes.Tags != nil {
+			for k, v := range record.Attributes.Tags {
+				tags[k] = v
+			}
+		} else {
+			res, err := svc.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			}, optFn)
+			if err != nil {
+				return fmt.Errorf("failed to get object tagging s3://%s/%s, %w", bucket, key, err)
+			}
+			for _, t := range res.TagSet {
+				tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+			}
+		}
+		for k, v := range actions.Tags {
+			ev, err := ExpandObjectTemplate(v, record, req.Capture, now)
+			if err != nil {
+				return err
+			}
+			tags[k] = ev
+		}
+		tagSet := make([]types.Tag, 0, len(tags))
+		for k, v := range tags {
+			tagSet = append(tagSet, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		r.logger.Printf("[info] [%s] Put tags to s3://%s/%s", req.MessageID, bucket, key)
+		if _, err := svc.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Tagging: &types.Tagging{TagSet: tagSet},
+		}, optFn); err != nil {
+			return fmt.Errorf("failed to put object tagging s3://%s/%s, %w", bucket, key, err)
+		}
+	}
+
+	if actions.CopyTo != "" {
+		dest, err := ExpandObjectTemplate(actions.CopyTo, record, req.Capture, now)
+		if err != nil {
+			return err
+		}
+		destBucket, destKey, err := parseCopyTo(bucket, dest)
+		if err != nil {
+			return err
+		}
+		if ok, _ := req.Target.Match(destBucket, destKey); ok {
+			// the copied object would be imported again by the target
+			return fmt.Errorf("copy_to destination s3://%s/%s matches the target itself", destBucket, destKey)
+		}
+		r.logger.Printf("[info] [%s] Copy s3://%s/%s to s3://%s/%s", req.MessageID, bucket, key, destBucket, destKey)
+		if _, err := svc.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(destBucket),
+			Key:        aws.String(destKey),
+			CopySource: aws.String(copySource(bucket, key)),
+		}, optFn); err != nil {
+			return fmt.Errorf("failed to copy object s3://%s/%s to s3://%s/%s, %w", bucket, key, destBucket, destKey, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Rin) deleteObject(ctx context.Context, req *ImportRequest) error {
+	bucket, key := req.Record.S3.Bucket.Name, req.Record.S3.Object.Key
+	r.logger.Printf("[info] [%s] Delete s3://%s/%s", req.MessageID, bucket, key)
+	if _, err := r.getS3Client().DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, s3OptFn(req.Target)); err != nil {
+		return fmt.Errorf("failed to delete object s3://%s/%s, %w", bucket, key, err)
+	}
+	return nil
+}
+
+func copySource(bucket, key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return bucket + "/" + strings.Join(parts, "/")
+}
@@ -0,0 +1,114 @@
+package rin_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+	"github.com/fujiwara/Rin/rintest"
+)
+
+func newActionsTestInstance(t *testing.T, imp rin.Importer) (*rin.Rin, *s3Recorder) {
+	t.Helper()
+	return newS3TestInstance(t, "test/config.actions.yml", imp)
+}
+
+var actionsTestEvent = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"incoming/foo/a%20b.json","size":10}}}]}`
+
+func TestOnSuccess(t *testing.T) {
+	r, rec := newActionsTestInstance(t, &memoryImporter{})
+	event, _ := rin.ParseEvent([]byte(actionsTestEvent))
+	if _, err := r.Import(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"GET /test.bucket.test/incoming/foo/a b.json?tagging",
+		"PUT /test.bucket.test/incoming/foo/a b.json?tagging",
+		"PUT /archive.bucket.test/archive/foo/incoming/foo/a b.json from test.bucket.test/incoming/foo/a%20b.json",
+		"DELETE /test.bucket.test/incoming/foo/a b.json",
+	}
+	if len(rec.requests) != len(expected) {
+		t.Fatalf("unexpected requests %v", rec.requests)
+	}
+	for i, req := range expected {
+		if rec.requests[i] != req {
+			t.Errorf("unexpected request %s expected %s", rec.requests[i], req)
+		}
+	}
+	for _, s := range []string{"<Key>owner</Key><Value>app</Value>", "<Key>rin-table</Key><Value>foo</Value>", "<Key>rin-loaded</Key>"} {
+		if !strings.Contains(rec.bodies[1], s) {
+			t.Errorf("tags must contain %s: %s", s, rec.bodies[1])
+		}
+	}
+}
+
+func TestOnFailure(t *testing.T) {
+	importErr := errors.New("failed")
+	r, rec := newActionsTestInstance(t, &failingImporter{err: importErr})
+	event, _ := rin.ParseEvent([]byte(actionsTestEvent))
+	if _, err := r.Import(context.Background(), event); !errors.Is(err, importErr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(rec.requests) != 2 || rec.requests[1] != "PUT /test.bucket.test/incoming/foo/a b.json?tagging" {
+		t.Fatalf("unexpected requests %v", rec.requests)
+	}
+	if !strings.Contains(rec.bodies[1], "<Key>rin-failed</Key><Value>true</Value>") {
+		t.Errorf("unexpected tags %s", rec.bodies[1])
+	}
+}
+
+func TestOnSuccessAfterAllTargets(t *testing.T) {
+	imp := &memoryImporter{}
+	r, rec := newActionsTestInstance(t, imp)
+	event, _ := rin.ParseEvent([]byte(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"multi/1.json","size":10}}}]}`))
+	if _, err := r.Import(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	if len(imp.imported) != 2 {
+		t.Errorf("the object must be imported into all targets %v", imp.imported)
+	}
+	expected := []string{
+		"PUT /test.bucket.test/archive/multi/1.json from test.bucket.test/multi/1.json",
+		"DELETE /test.bucket.test/multi/1.json",
+	}
+	if strings.Join(rec.requests, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected requests %v", rec.requests)
+	}
+}
+
+func TestOnFailureFinalAttempt(t *testing.T) {
+	h := newHarness(t, "test/config.actions.yml", rin.WithImporter("memory", func(_ *rin.Rin, _ *rin.Target) (rin.Importer, error) {
+		return &failingImporter{err: errors.New("failed")}, nil
+	}))
+	h.sqs.VisibilityTimeout = 200 * time.Millisecond
+	h.s3.Put("test.bucket.test", "incoming/foo/1.json", &rintest.Object{Body: []byte(`{}`)})
+	h.sqs.Send("rin_actions", s3Event("incoming/foo/1.json"))
+
+	h.run(t)
+	if obj, _ := h.s3.Get("test.bucket.test", "incoming/foo/1.json"); obj.Tags["rin-failed"] != "" {
+		t.Errorf("on_failure must not run before the final attempt %v", obj.Tags)
+	}
+	time.Sleep(300 * time.Millisecond)
+	h.run(t)
+	if obj, _ := h.s3.Get("test.bucket.test", "incoming/foo/1.json"); obj.Tags["rin-failed"] != "true" {
+		t.Errorf("on_failure must run at the final attempt %v", obj.Tags)
+	}
+}
+
+func TestExpandObjectTemplate(t *testing.T) {
+	record := &rin.EventRecord{}
+	record.S3.Bucket.Name = "bucket"
+	record.S3.Object.Key = "logs/app/1.json"
+	record.Attributes = &rin.ObjectAttributes{Metadata: map[string]string{"source": "batch"}}
+	now := time.Date(2022, 12, 1, 9, 0, 0, 0, time.FixedZone("JST", 9*3600))
+	s, err := rin.ExpandObjectTemplate("archive/$1/${metadata:source}/${timestamp}/${key}@${bucket}", record, &[]string{"logs/app/", "app"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "archive/app/batch/2022-12-01T00:00:00Z/logs/app/1.json@bucket"; s != expected {
+		t.Errorf("unexpected %s expected %s", s, expected)
+	}
+}
@@ -0,0 +1,235 @@
+package rin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateRunning  = "running"
+	StatePaused   = "paused"
+	StateDraining = "draining"
+)
+
+// AdminShutdownTimeout is the timeout to shutdown the admin API server.
+var AdminShutdownTimeout = 5 * time.Second
+
+// Admin represents the admin HTTP API to pause, resume and drain workers.
+// Requests must have the token in the Authorization header as "Bearer {token}".
+type Admin struct {
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token"`
+}
+
+func (a *Admin) setup() error {
+	if a.Listen == "" {
+		return fmt.Errorf("admin.listen is required")
+	}
+	if a.Token == "" {
+		return fmt.Errorf("admin.token is required")
+	}
+	return nil
+}
+
+// WorkerStatus represents the state of workers and messages in flight.
+type WorkerStatus struct {
+	State    string             `json:"state"`
+	InFlight []*InFlightMessage `json:"in_flight"`
+}
+
+// InFlightMessage represents a message which is being processed.
+type InFlightMessage struct {
+	MessageID string    `json:"message_id"`
+	Queue     string    `json:"queue"`
+	Targets   []string  `json:"targets"` // targets which records of the message were matched
+	StartedAt time.Time `json:"started_at"`
+	Elapsed   float64   `json:"elapsed"` // seconds
+}
+
+// workerState controls receiving of workers and tracks messages in flight.
+type workerState struct {
+	mu       sync.Mutex
+	paused   bool
+	resumed  chan struct{} // closed when workers are resumed
+	drain    chan struct{} // closed when workers are drained
+	draining bool
+	messages map[string]*InFlightMessage
+}
+
+func newWorkerState() *workerState {
+	return &workerState{
+		drain:    make(chan struct{}),
+		messages: make(map[string]*InFlightMessage),
+	}
+}
+
+// wait blocks while workers are paused. It returns false when workers are drained or ctx is done.
+func (s *workerState) wait(ctx context.Context) bool {
+	s.mu.Lock()
+	if !s.paused {
+		s.mu.Unlock()
+		return true
+	}
+	resumed := s.resumed
+	s.mu.Unlock()
+	select {
+	case <-resumed:
+		return true
+	case <-s.drain:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (s *workerState) start(msgId, queue string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[msgId] = &InFlightMessage{MessageID: msgId, Queue: queue, Targets: []string{}, StartedAt: time.Now()}
+}
+
+func (s *workerState) addTarget(msgId string, target *Target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.messages[msgId]; m != nil {
+		m.Targets = append(m.Targets, target.String())
+	}
+}
+
+func (s *workerState) done(msgId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, msgId)
+}
+
+// Pause stops workers receiving messages. Messages in flight are processed.
+func (r *Rin) Pause() {
+	s := r.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused || s.draining {
+		return
+	}
+	s.paused = true
+	s.resumed = make(chan struct{})
+	r.logger.Println("[info] Workers are paused")
+}
+
+// Resume restarts workers receiving messages.
+func (r *Rin) Resume() {
+	s := r.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused || s.draining {
+		return
+	}
+	s.paused = false
+	close(s.resumed)
+	r.logger.Println("[info] Workers are resumed")
+}
+
+// Drain stops workers receiving messages. Run returns after messages in flight are processed.
+func (r *Rin) Drain() {
+	s := r.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return
+	}
+	s.draining = true
+	close(s.drain)
+	r.logger.Println("[info] Workers are draining")
+}
+
+// Status returns the state of workers and messages in flight in the order of start.
+func (r *Rin) Status() *WorkerStatus {
+	s := r.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &WorkerStatus{State: StateRunning, InFlight: make([]*InFlightMessage, 0, len(s.messages))}
+	switch {
+	case s.draining:
+		status.State = StateDraining
+	case s.paused:
+		status.State = StatePaused
+	}
+	for _, m := range s.messages {
+		c := *m
+		c.Targets = append([]string{}, m.Targets...)
+		c.Elapsed = time.Since(m.StartedAt).Seconds()
+		status.InFlight = append(status.InFlight, &c)
+	}
+	sort.Slice(status.InFlight, func(i, j int) bool {
+		return status.InFlight[i].StartedAt.Before(status.InFlight[j].StartedAt)
+	})
+	return status
+}
+
+// AdminHandler returns a handler of the admin API.
+//
+//	POST /pause, POST /resume, POST /drain, GET /status
+//
+// All endpoints respond the status of workers as JSON.
+func (r *Rin) AdminHandler() http.Handler {
+	var token string
+	if r.config.Admin != nil {
+		token = r.config.Admin.Token
+	}
+	actions := map[string]func(){
+		"/pause":  r.Pause,
+		"/resume": r.Resume,
+		"/drain":  r.Drain,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if action, ok := actions[req.URL.Path]; ok {
+			if req.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			r.logger.Printf("[info] Admin API %s from %s", req.URL.Path, req.RemoteAddr)
+			action()
+		} else if req.URL.Path != "/status" {
+			http.NotFound(w, req)
+			return
+		} else if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Status())
+	})
+}
+
+// startAdmin starts the admin API server. The returned function shuts it down.
+func (r *Rin) startAdmin() (func(), error) {
+	ln, err := net.Listen("tcp", r.config.Admin.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen admin API, %w", err)
+	}
+	srv := &http.Server{Handler: r.AdminHandler()}
+	r.logger.Printf("[info] Admin API is listening on %s", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			r.logger.Printf("[error] Admin API server stopped. %s", err)
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), AdminShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,114 @@
+package rin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func adminRequest(t *testing.T, url, method, path, token string) (int, *rin.WorkerStatus) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, nil
+	}
+	var status rin.WorkerStatus
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, &status
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := newHarness(t, "test/config.admin.yml", withMemoryImporter(&memoryImporter{}))
+	ts := httptest.NewServer(h.rin.AdminHandler())
+	defer ts.Close()
+
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := adminRequest(t, ts.URL, http.MethodGet, "/status", token); code != http.StatusUnauthorized {
+			t.Errorf("unexpected status %d for token %q", code, token)
+		}
+	}
+	if code, _ := adminRequest(t, ts.URL, http.MethodGet, "/pause", "secret"); code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status %d", code)
+	}
+	if code, _ := adminRequest(t, ts.URL, http.MethodPost, "/unknown", "secret"); code != http.StatusNotFound {
+		t.Errorf("unexpected status %d", code)
+	}
+	if code, status := adminRequest(t, ts.URL, http.MethodGet, "/status", "secret"); code != http.StatusOK || status.State != rin.StateRunning {
+		t.Errorf("unexpected status %d %v", code, status)
+	}
+}
+
+func TestAdminPauseResumeDrain(t *testing.T) {
+	imp := &blockingImporter{started: make(chan string), release: make(chan struct{})}
+	h := newHarness(t, "test/config.admin.yml",
+		withMemoryImporter(imp),
+		rin.WithOption(&rin.Option{}),
+	)
+	// the message in flight must not be delivered again
+	h.sqs.VisibilityTimeout = time.Minute
+	ts := httptest.NewServer(h.rin.AdminHandler())
+	defer ts.Close()
+
+	if _, status := adminRequest(t, ts.URL, http.MethodPost, "/pause", "secret"); status.State != rin.StatePaused {
+		t.Errorf("unexpected state %s", status.State)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- h.rin.Run(ctx)
+	}()
+	id := h.sqs.Send("rin_admin", s3Event("logs/1.json"))
+	time.Sleep(300 * time.Millisecond)
+	if n := h.sqs.Receives(id); n != 0 {
+		t.Fatalf("paused workers must not receive messages. received %d times", n)
+	}
+
+	adminRequest(t, ts.URL, http.MethodPost, "/resume", "secret")
+	if started := <-imp.started; started != id {
+		t.Errorf("unexpected message %s", started)
+	}
+	_, status := adminRequest(t, ts.URL, http.MethodGet, "/status", "secret")
+	if status.State != rin.StateRunning || len(status.InFlight) != 1 {
+		t.Fatalf("unexpected status %#v", status)
+	}
+	if m := status.InFlight[0]; m.MessageID != id || m.Queue != "rin_admin" || len(m.Targets) != 1 || m.Elapsed <= 0 {
+		t.Errorf("unexpected in-flight message %#v", m)
+	}
+
+	if _, status := adminRequest(t, ts.URL, http.MethodPost, "/drain", "secret"); status.State != rin.StateDraining {
+		t.Errorf("unexpected state %s", status.State)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("workers must wait for messages in flight. %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	close(imp.release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("workers were not drained")
+	}
+	if d := h.sqs.Deleted("rin_admin"); len(d) != 1 {
+		t.Errorf("the message in flight must be completed %v", d)
+	}
+}
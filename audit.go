@@ -0,0 +1,224 @@
+package rin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	OutcomeImported  = "imported"
+	OutcomeRemoved   = "removed"
+	OutcomeDiscarded = "discarded"
+	OutcomeFailed    = "failed"
+
+	AuditRedshift = "redshift"
+	AuditS3       = "s3"
+
+	AuditInsertSQLTemplate = "/* Rin */ INSERT INTO %s (message_id, bucket, object_key, etag, object_size, target, table_name, sql_hash, loaded_rows, duration, outcome, error, created_at) VALUES %s"
+)
+
+// AuditTimeout is the timeout to write audit records. They are written even if the context of the message is canceled.
+var AuditTimeout = 30 * time.Second
+
+// ImportResult represents the result of a record for a target.
+type ImportResult struct {
+	MessageID string        `json:"message_id"`
+	Bucket    string        `json:"bucket"`
+	Key       string        `json:"key"`
+	ETag      string        `json:"etag"`
+	Size      int64         `json:"size"`
+	Target    string        `json:"target"`
+	Table     string        `json:"table,omitempty"` // schema.table expanded for the record
+	SQLHash   string        `json:"sql_hash,omitempty"`
+	Rows      int64         `json:"rows"` // -1 if unknown
+	Duration  time.Duration `json:"-"`
+	Outcome   string        `json:"outcome"`
+	Error     string        `json:"error,omitempty"`
+	Time      time.Time     `json:"time"`
+}
+
+func (res *ImportResult) MarshalJSON() ([]byte, error) {
+	type result ImportResult
+	return json.Marshal(struct {
+		*result
+		Duration float64 `json:"duration"`
+	}{(*result)(res), res.Duration.Seconds()})
+}
+
+func newImportResult(msgId string, target *Target, record *EventRecord, capture *[]string) *ImportResult {
+	return &ImportResult{
+		MessageID: msgId,
+		Bucket:    record.S3.Bucket.Name,
+		Key:       record.S3.Object.Key,
+		ETag:      record.S3.Object.ETag,
+		Size:      record.S3.Object.Size,
+		Target:    target.String(),
+		Table:     target.qualifiedTable(record, capture),
+		Rows:      -1,
+		Time:      time.Now(),
+	}
+}
+
+// ImportResults represents results of records imported by an event.
+type ImportResults []*ImportResult
+
+// Processed returns the number of results which were not failed.
+func (rs ImportResults) Processed() int {
+	var n int
+	for _, res := range rs {
+		if res.Outcome != OutcomeFailed {
+			n++
+		}
+	}
+	return n
+}
+
+// Rows returns the total number of rows loaded. Unknown rows are not counted.
+func (rs ImportResults) Rows() int64 {
+	var n int64
+	for _, res := range rs {
+		if res.Rows > 0 {
+			n += res.Rows
+		}
+	}
+	return n
+}
+
+// Report records the number of rows loaded and the statements executed into the result of the request.
+func (req *ImportRequest) Report(rows int64, stmts ...string) {
+	if req.Result == nil {
+		return
+	}
+	req.Result.Rows = rows
+	if len(stmts) > 0 {
+		req.Result.SQLHash = sqlHash(stmts)
+	}
+}
+
+func sqlHash(stmts []string) string {
+	h := sha256.Sum256([]byte(strings.Join(stmts, ";\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// Audit represents a sink of audit records. Results of imports are written into a Redshift table or JSON lines on S3.
+type Audit struct {
+	Type      string `yaml:"type"`
+	Schema    string `yaml:"schema"`
+	Table     string `yaml:"table"`
+	Bucket    string `yaml:"bucket"`
+	KeyPrefix string `yaml:"key_prefix"`
+	Region    string `yaml:"region"`
+}
+
+func (a *Audit) setup() error {
+	switch a.Type {
+	case AuditRedshift:
+		if a.Table == "" {
+			return fmt.Errorf("audit.table is required for %s", a.Type)
+		}
+	case AuditS3:
+		if a.Bucket == "" {
+			return fmt.Errorf("audit.bucket is required for %s", a.Type)
+		}
+	default:
+		return fmt.Errorf("audit.type must be %s or %s", AuditRedshift, AuditS3)
+	}
+	return nil
+}
+
+// auditTarget returns a target to write audit records by the connection of the redshift section.
+func (c *Config) auditTarget() *Target {
+	rs := *c.Redshift
+	rs.Schema, rs.Table = c.Audit.Schema, c.Audit.Table
+	return &Target{Type: TypeRedshift, Redshift: &rs, S3: &S3{}}
+}
+
+// BuildAuditSQL builds an INSERT query for the results. Values are escaped as literals, because keys and errors come from outside.
+func BuildAuditSQL(table string, results ImportResults) string {
+	values := make([]string, 0, len(results))
+	for _, res := range results {
+		values = append(values, fmt.Sprintf("(%s, %s, %s, %s, %d, %s, %s, %s, %d, %f, %s, %s, %s)",
+			quoteLiteral(res.MessageID),
+			quoteLiteral(res.Bucket),
+			quoteLiteral(res.Key),
+			quoteLiteral(res.ETag),
+			res.Size,
+			quoteLiteral(res.Target),
+			quoteLiteral(res.Table),
+			quoteLiteral(res.SQLHash),
+			res.Rows,
+			res.Duration.Seconds(),
+			quoteLiteral(res.Outcome),
+			quoteLiteral(res.Error),
+			quoteLiteral(res.Time.UTC().Format("2006-01-02 15:04:05.000000")),
+		))
+	}
+	return fmt.Sprintf(AuditInsertSQLTemplate, table, strings.Join(values, ", "))
+}
+
+// writeAudit writes the results into the audit sink. The errors are logged and not returned.
+func (r *Rin) writeAudit(msgId string, results ImportResults) {
+	a := r.config.Audit
+	if a == nil || len(results) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), AuditTimeout)
+	defer cancel()
+	var err error
+	switch a.Type {
+	case AuditRedshift:
+		err = r.writeAuditRedshift(ctx, results)
+	case AuditS3:
+		err = r.writeAuditS3(ctx, msgId, results)
+	}
+	if err != nil {
+		r.logger.Printf("[error] [%s] Failed to write %d audit records to %s. %s", msgId, len(results), a.Type, err)
+	}
+}
+
+func (r *Rin) writeAuditRedshift(ctx context.Context, results ImportResults) error {
+	target := r.auditTarget
+	table, err := target.tableName(&[]string{}, nil)
+	if err != nil {
+		return err
+	}
+	_, err = r.execRedshift(ctx, target, "", []string{BuildAuditSQL(table, results)}, -1)
+	return err
+}
+
+func (r *Rin) writeAuditS3(ctx context.Context, msgId string, results ImportResults) error {
+	a := r.config.Audit
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, res := range results {
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	}
+	if msgId == "" {
+		msgId = "import"
+	}
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s%s/%s-%s.jsonl", a.KeyPrefix, now.Format("2006/01/02"), now.Format("20060102T150405.000000000Z"), msgId)
+	r.logger.Printf("[debug] [%s] Put audit records to s3://%s/%s", msgId, a.Bucket, key)
+	_, err := r.getS3Client().PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(a.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	}, func(o *s3.Options) {
+		if a.Region != "" {
+			o.Region = a.Region
+		}
+	})
+	return err
+}
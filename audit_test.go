@@ -0,0 +1,120 @@
+package rin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestAuditRedshift(t *testing.T) {
+	f := &fakeRedshiftData{status: "FINISHED", rows: 10}
+	r := newTestInstance(t, "test/config.audit.yml", rin.WithRedshiftDataClient(f))
+
+	event, _ := rin.ParseEvent([]byte(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"test/foo/1.json","size":100,"eTag":"abc"}}}]}`))
+	results, err := r.Import(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("unexpected results %d", len(results))
+	}
+	res := results[0]
+	if res.Outcome != rin.OutcomeImported || res.Rows != 10 || res.Table != "public.foo" || res.ETag != "abc" || res.Size != 100 {
+		t.Errorf("unexpected result %#v", res)
+	}
+	if len(res.SQLHash) != 64 {
+		t.Errorf("unexpected sql hash %s", res.SQLHash)
+	}
+	if len(f.executed) != 2 {
+		t.Fatalf("unexpected executed %v", f.executed)
+	}
+	audit := f.executed[1][0]
+	for _, s := range []string{`INSERT INTO "rin"."audit"`, `'test.bucket.test', 'test/foo/1.json', 'abc', 100,`, `'public.foo', '` + res.SQLHash + `', 10,`, `'imported'`} {
+		if !strings.Contains(audit, s) {
+			t.Errorf("audit SQL must contain %s: %s", s, audit)
+		}
+	}
+}
+
+func TestBuildAuditSQLEscape(t *testing.T) {
+	results := rin.ImportResults{{Bucket: "test.bucket.test", Key: `test/foo/\'); DROP TABLE foo; --.json`, Error: `can't load`}}
+	q := rin.BuildAuditSQL(`"rin"."audit"`, results)
+	for _, s := range []string{`'test/foo/\\''); DROP TABLE foo; --.json'`, `'can''t load'`} {
+		if !strings.Contains(q, s) {
+			t.Errorf("audit SQL must contain %s: %s", s, q)
+		}
+	}
+}
+
+func TestAuditS3(t *testing.T) {
+	imp := &reportingImporter{}
+	r, rec := newS3TestInstance(t, "test/config.audit_s3.yml", imp)
+	event, _ := rin.ParseEvent([]byte(`{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"incoming/foo/1.json","size":10,"eTag":"e1"}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"incoming/bar/2.json","size":20,"eTag":"e2"}}}
+	]}`))
+	if err := r.ProcessMessage(context.Background(), "msg1", jsonString(t, event)); err != nil {
+		t.Fatal(err)
+	}
+
+	imp.err = errors.New("failed to load")
+	if err := r.ProcessMessage(context.Background(), "msg2", jsonString(t, event)); err == nil {
+		t.Fatal("ProcessMessage must be failed")
+	}
+
+	if len(rec.requests) != 2 {
+		t.Fatalf("unexpected requests %v", rec.requests)
+	}
+	for i, msgId := range []string{"msg1", "msg2"} {
+		if !strings.HasPrefix(rec.requests[i], "PUT /audit.bucket.test/rin/audit/") || !strings.HasSuffix(rec.requests[i], "-"+msgId+".jsonl") {
+			t.Errorf("unexpected request %s", rec.requests[i])
+		}
+	}
+
+	var results []map[string]interface{}
+	for _, body := range rec.bodies {
+		dec := json.NewDecoder(strings.NewReader(body))
+		for dec.More() {
+			var v map[string]interface{}
+			if err := dec.Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, v)
+		}
+	}
+	// the failed message stops at the first record
+	if len(results) != 3 {
+		t.Fatalf("unexpected audit records %v", results)
+	}
+	expected := []string{
+		"msg1 incoming/foo/1.json e1 public.foo imported 42",
+		"msg1 incoming/bar/2.json e2 public.bar imported 42",
+		"msg2 incoming/foo/1.json e1 public.foo failed -1",
+	}
+	for i, v := range results {
+		s := fmt.Sprintf("%s %s %s %s %s %v", v["message_id"], v["key"], v["etag"], v["table"], v["outcome"], v["rows"])
+		if s != expected[i] {
+			t.Errorf("unexpected audit record %s", s)
+		}
+		if _, ok := v["duration"].(float64); !ok {
+			t.Errorf("duration must be a number %v", v["duration"])
+		}
+	}
+	if results[2]["error"] != "failed to load" {
+		t.Errorf("unexpected error %v", results[2]["error"])
+	}
+}
+
+func jsonString(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
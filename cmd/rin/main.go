@@ -34,6 +34,8 @@ func main() {
 	flag.BoolVar(&opt.BatchMode, "b", false, "batch mode")
 	flag.DurationVar(&opt.MaxExecutionTime, "max-execution-time", 0, "max execution time")
 	flag.BoolVar(&dryRun, "dry-run", false, "dry run mode (load configuration only)")
+	flag.StringVar(&opt.Local, "local", "", "read events from a file, a directory or stdin (-) instead of SQS")
+	flag.StringVar(&opt.LocalQueue, "local-queue", "", "import local events into the targets of the queue")
 	flag.VisitAll(func(f *flag.Flag) {
 		if len(f.Name) <= 1 {
 			return
@@ -44,6 +46,12 @@ func main() {
 		}
 	})
 	flag.Parse()
+	var validate bool
+	if flag.Arg(0) == "validate" {
+		// rin [flags] validate [flags]
+		validate = true
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 
 	if showVersion {
 		fmt.Println("version:", version)
@@ -67,6 +75,8 @@ func main() {
 	run := rin.Run
 	if dryRun {
 		run = rin.DryRun
+	} else if validate {
+		run = rin.Validate
 	}
 	if err := run(config, opt); err != nil {
 		log.Println("[error]", err)
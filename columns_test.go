@@ -0,0 +1,63 @@
+package rin_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestColumns(t *testing.T) {
+	r := newTestInstance(t, "test/config.columns.yml", rin.WithRedshiftDataClient(&fakeRedshiftData{}))
+	cred := r.Config().Credentials
+	expected := map[string]string{
+		"foo/1.json":           `/* Rin */ COPY "foo" ("id", "Name", "we""ird") FROM 's3://test.bucket.test/foo/1.json'`,
+		"templated/app/1.json": `/* Rin */ COPY "app" ("id", "app_id") FROM 's3://test.bucket.test/templated/app/1.json'`,
+	}
+	for i, key := range []string{"foo/1.json", "templated/app/1.json"} {
+		target := r.Config().Targets[i]
+		_, capture := target.Match("test.bucket.test", key)
+		sql, err := target.BuildCopySQL(key, cred, capture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(sql, expected[key]) {
+			t.Errorf("unexpected SQL %s", sql)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFinished, results: []string{"id", "name", `we"ird`}}
+	r := newTestInstance(t, "test/config.columns.yml", rin.WithRedshiftDataClient(f))
+	err := r.Validate(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "columns missing are not found in app.bar") {
+		t.Errorf("unexpected error %v", err)
+	}
+	// the templated target is not validated
+	if len(f.executed) != 2 {
+		t.Errorf("unexpected executed %v", f.executed)
+	}
+	if s := f.executed[1][0]; !strings.Contains(s, "table_schema = 'app' AND table_name = 'bar'") {
+		t.Errorf("unexpected query %s", s)
+	}
+
+	// columns are not validated when the database is not reachable
+	f = &fakeRedshiftData{status: types.StatusStringFinished, execErr: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	r = newTestInstance(t, "test/config.columns.yml", rin.WithRedshiftDataClient(f))
+	if err := r.Validate(context.Background()); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+
+	// other errors fail the validation
+	f = &fakeRedshiftData{status: types.StatusStringFinished, execErr: errors.New("permission denied")}
+	r = newTestInstance(t, "test/config.columns.yml", rin.WithRedshiftDataClient(f))
+	if err := r.Validate(context.Background()); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -2,14 +2,16 @@ package rin
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
@@ -24,22 +26,102 @@ const (
 	S3URITemplate = "s3://%s/%s"
 	SQLTemplate   = "/* Rin */ COPY %s FROM %s CREDENTIALS '%s' REGION '%s' %s"
 	// Prefix SQL comment "/* Rin */". Because a query which start with "COPY", pq expect a PostgreSQL COPY command response, but a Redshift response is different it.
+	DeleteSQLTemplate = "/* Rin */ DELETE FROM %s WHERE %s"
 
 	DriverPostgres     = "postgres"
 	DriverRedshiftData = "redshift-data"
+
+	TypeRedshift = "redshift"
 )
 
 func quoteValue(v string) string {
 	return "'" + strings.Replace(v, "'", "''", -1) + "'"
 }
 
+var literalEscaper = strings.NewReplacer(`\`, `\\`, "'", "''")
+
+// escapeLiteral escapes a value from outside (object keys, captured values and attributes) to be embedded in a string literal.
+// Redshift treats backslashes in string literals as escape characters, so they are escaped as well as quotes.
+func escapeLiteral(v string) string {
+	return literalEscaper.Replace(v)
+}
+
+func quoteLiteral(v string) string {
+	return "'" + escapeLiteral(v) + "'"
+}
+
 type Config struct {
-	QueueName   string      `yaml:"queue_name"`
-	Targets     []*Target   `yaml:"targets"`
-	Credentials Credentials `yaml:"credentials"`
-	Redshift    *Redshift   `yaml:"redshift"`
-	S3          *S3         `yaml:"s3"`
-	SQLOption   string      `yaml:"sql_option"`
+	QueueName   string       `yaml:"queue_name"`
+	Queues      []*Queue     `yaml:"queues"`
+	Targets     []*Target    `yaml:"targets"`
+	Credentials Credentials  `yaml:"credentials"`
+	Redshift    *Redshift    `yaml:"redshift"`
+	S3          *S3          `yaml:"s3"`
+	SQLOption   string       `yaml:"sql_option"`
+	Copy        *CopyOptions `yaml:"copy"`
+
+	RedshiftData *RedshiftDataOption `yaml:"redshift_data"`
+	Notifiers    []*NotifierConfig   `yaml:"notifiers"`
+	Audit        *Audit              `yaml:"audit"`
+	Admin        *Admin              `yaml:"admin"`
+}
+
+// RedshiftDataOption represents options for statements executed by the Redshift Data API.
+type RedshiftDataOption struct {
+	PollingInterval string `yaml:"polling_interval"`
+	StateFile       string `yaml:"state_file"`
+
+	pollingInterval time.Duration
+}
+
+const DefaultPollingInterval = time.Second
+
+func (o *RedshiftDataOption) setup() error {
+	if o.PollingInterval == "" {
+		o.pollingInterval = DefaultPollingInterval
+		return nil
+	}
+	d, err := time.ParseDuration(o.PollingInterval)
+	if err != nil {
+		return fmt.Errorf("invalid redshift_data.polling_interval: %w", err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("redshift_data.polling_interval must be positive")
+	}
+	o.pollingInterval = d
+	return nil
+}
+
+type Queue struct {
+	Name            string    `yaml:"name"`
+	Targets         []*Target `yaml:"targets"`
+	TargetTag       string    `yaml:"target_tag"`
+	Workers         int       `yaml:"workers"`
+	BatchSize       int32     `yaml:"batch_size"`
+	WaitTimeSeconds int32     `yaml:"wait_time_seconds"`
+	MaxInFlight     int       `yaml:"max_in_flight"`
+	Defer           string    `yaml:"defer"`
+	MaxReceiveCount int       `yaml:"max_receive_count"`
+
+	targets []*Target
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("%s (workers: %d, batch_size: %d, targets: %d)", q.Name, q.Workers, q.BatchSize, len(q.targets))
+}
+
+func (q *Queue) IsFIFO() bool {
+	return strings.HasSuffix(q.Name, ".fifo")
+}
+
+// isFinalAttempt reports whether a message received receiveCount times is not delivered again, by max_receive_count.
+func (q *Queue) isFinalAttempt(receiveCount int) bool {
+	return q.MaxReceiveCount > 0 && receiveCount >= q.MaxReceiveCount
+}
+
+// ResolvedTargets returns the targets which messages from the queue are imported into.
+func (q *Queue) ResolvedTargets() []*Target {
+	return q.targets
 }
 
 type Credentials struct {
@@ -58,13 +140,40 @@ func (c Credentials) RedshiftCredential() string {
 }
 
 type Target struct {
-	Redshift  *Redshift `yaml:"redshift"`
-	S3        *S3       `yaml:"s3"`
-	SQLOption string    `yaml:"sql_option"`
-	Break     bool      `yaml:"break"`
-	Discard   bool      `yaml:"discard"`
+	Type       string         `yaml:"type"`
+	Redshift   *Redshift      `yaml:"redshift"`
+	S3         *S3            `yaml:"s3"`
+	SQLOption  string         `yaml:"sql_option"`
+	Copy       *CopyOptions   `yaml:"copy"`
+	Columns    []string       `yaml:"columns"`
+	Tags       []string       `yaml:"tags"`
+	Break      bool           `yaml:"break"`
+	Discard    bool           `yaml:"discard"`
+	EventNames []string       `yaml:"event_names"`
+	OnRemove   *OnRemove      `yaml:"on_remove"`
+	Stream     *Stream        `yaml:"stream"`
+	SQLBefore  []string       `yaml:"sql_before"`
+	SQLAfter   []string       `yaml:"sql_after"`
+	RateLimit  float64        `yaml:"rate_limit"`
+	RateBurst  int            `yaml:"rate_burst"`
+	OnSuccess  *ObjectActions `yaml:"on_success"`
+	OnFailure  *ObjectActions `yaml:"on_failure"`
+	NonEmpty   bool           `yaml:"non_empty"`
+	Schedule   []string       `yaml:"schedule"`
+	Blackout   []string       `yaml:"blackout"`
+
+	CreateTable *CreateTable `yaml:"create_table"`
+	SchemaDrift *SchemaDrift `yaml:"schema_drift"`
+
+	schedule         []*Cron
+	blackout         []*Cron
+	keyMatcher       func(string) (bool, *[]string)
+	eventMatcher     func(string) bool
+	attributeMatcher *attributeMatcher
+}
 
-	keyMatcher func(string) (bool, *[]string)
+type OnRemove struct {
+	Where string `yaml:"where"`
 }
 
 type SQLParam struct {
@@ -76,6 +185,8 @@ func (t *Target) String() string {
 	var s string
 	if t.Discard {
 		s = strings.Join([]string{t.S3.String(), "Discard"}, " => ")
+	} else if t.Type != TypeRedshift {
+		s = strings.Join([]string{t.S3.String(), t.Type + ":" + t.Redshift.TableString()}, " => ")
 	} else {
 		s = strings.Join([]string{t.S3.String(), t.Redshift.String()}, " => ")
 	}
@@ -85,86 +196,236 @@ func (t *Target) String() string {
 	return s
 }
 
-func (t *Target) Match(bucket, key string) (bool, *[]string) {
-	if bucket != t.S3.Bucket {
-		return false, nil
+func expandPlaceHolder(s string, capture *[]string) string {
+	for i, v := range *capture {
+		s = strings.Replace(s, "$"+strconv.Itoa(i), v, -1)
+	}
+	return s
+}
+
+// ExpandTable returns the schema and table name expanded by the captured values and the attributes of the record.
+// The schema is empty when it is not defined.
+func (t *Target) ExpandTable(record *EventRecord, capture *[]string) (string, string, error) {
+	var attrs *ObjectAttributes
+	if record != nil {
+		attrs = record.Attributes
 	}
-	return t.keyMatcher(key)
+	return t.expandTable(capture, attrs)
 }
 
-func (t *Target) MatchEventRecord(r *EventRecord) (bool, *[]string) {
-	return t.Match(r.S3.Bucket.Name, r.S3.Object.Key)
+// qualifiedTable returns schema.table expanded for the record, or empty when it can't be expanded.
+func (t *Target) qualifiedTable(record *EventRecord, capture *[]string) string {
+	if t.Redshift == nil {
+		return ""
+	}
+	schema, table, err := t.ExpandTable(record, capture)
+	if err != nil {
+		return ""
+	}
+	if schema == "" {
+		schema = "public"
+	}
+	return schema + "." + table
 }
 
-func (t *Target) buildKeyMatcher() error {
-	if prefix := t.S3.KeyPrefix; prefix != "" {
-		t.keyMatcher = func(key string) (bool, *[]string) {
-			if strings.HasPrefix(key, prefix) {
-				capture := []string{key}
-				return true, &capture
-			} else {
-				return false, nil
-			}
-		}
-	} else if r := t.S3.KeyRegexp; r != "" {
-		reg, err := regexp.Compile(r)
+func (t *Target) expandTable(capture *[]string, attrs *ObjectAttributes) (string, string, error) {
+	table, err := expandAttributes(expandPlaceHolder(t.Redshift.Table, capture), attrs)
+	if err != nil {
+		return "", "", err
+	}
+	if t.Redshift.Schema == "" {
+		return "", table, nil
+	}
+	schema, err := expandAttributes(expandPlaceHolder(t.Redshift.Schema, capture), attrs)
+	if err != nil {
+		return "", "", err
+	}
+	return schema, table, nil
+}
+
+func (t *Target) tableName(capture *[]string, attrs *ObjectAttributes) (string, error) {
+	schema, table, err := t.expandTable(capture, attrs)
+	if err != nil {
+		return "", err
+	}
+	if schema == "" {
+		return pq.QuoteIdentifier(table), nil
+	}
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table), nil
+}
+
+// tableWithColumns returns the table name followed by the column list of COPY, such as "table" ("c1", "c2").
+func (t *Target) tableWithColumns(capture *[]string, attrs *ObjectAttributes) (string, error) {
+	table, err := t.tableName(capture, attrs)
+	if err != nil {
+		return "", err
+	}
+	cols, err := t.ExpandColumns(capture, attrs)
+	if err != nil {
+		return "", err
+	}
+	if len(cols) == 0 {
+		return table, nil
+	}
+	for i, c := range cols {
+		cols[i] = pq.QuoteIdentifier(c)
+	}
+	return table + " (" + strings.Join(cols, ", ") + ")", nil
+}
+
+// ExpandColumns returns the columns expanded by the captured values and the attributes.
+func (t *Target) ExpandColumns(capture *[]string, attrs *ObjectAttributes) ([]string, error) {
+	if len(t.Columns) == 0 {
+		return nil, nil
+	}
+	cols := make([]string, 0, len(t.Columns))
+	for _, c := range t.Columns {
+		col, err := expandAttributes(expandPlaceHolder(c, capture), attrs)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		t.keyMatcher = func(key string) (bool, *[]string) {
-			capture := reg.FindStringSubmatch(key)
-			if len(capture) == 0 {
-				return false, nil
-			} else {
-				return true, &capture
-			}
+		if col == "" {
+			return nil, fmt.Errorf("column %s is expanded to empty", c)
 		}
-	} else {
-		return fmt.Errorf("target.key_prefix or key_regexp is not defined")
+		cols = append(cols, col)
 	}
-	return nil
+	return cols, nil
 }
 
-func expandPlaceHolder(s string, capture *[]string) string {
-	for i, v := range *capture {
-		s = strings.Replace(s, "$"+strconv.Itoa(i), v, -1)
+func (t *Target) validateColumns() error {
+	names := make(map[string]bool, len(t.Columns))
+	for _, c := range t.Columns {
+		if strings.TrimSpace(c) == "" {
+			return fmt.Errorf("target.columns must not contain empty names")
+		}
+		if names[strings.ToLower(c)] {
+			return fmt.Errorf("target.columns has duplicated column %s", c)
+		}
+		names[strings.ToLower(c)] = true
 	}
-	return s
+	return nil
 }
 
 func (t *Target) BuildCopySQL(key string, cred Credentials, capture *[]string) (string, error) {
-	var table string
-	_table := expandPlaceHolder(t.Redshift.Table, capture)
-	if t.Redshift.Schema == "" {
-		table = pq.QuoteIdentifier(_table)
-	} else {
-		_schema := expandPlaceHolder(t.Redshift.Schema, capture)
-		table = pq.QuoteIdentifier(_schema) + "." + pq.QuoteIdentifier(_table)
+	return t.buildCopySQL(key, cred, capture, nil)
+}
+
+// BuildCopySQLForRecord builds a COPY query for the record. ${metadata:name} and ${tag:name} are expanded by the attributes of the record.
+func (t *Target) BuildCopySQLForRecord(record *EventRecord, cred Credentials, capture *[]string) (string, error) {
+	return t.buildCopySQL(record.S3.Object.Key, cred, capture, record.Attributes)
+}
+
+func (t *Target) buildCopySQL(key string, cred Credentials, capture *[]string, attrs *ObjectAttributes) (string, error) {
+	table, err := t.tableWithColumns(capture, attrs)
+	if err != nil {
+		return "", err
 	}
 	query := fmt.Sprintf(
 		SQLTemplate,
 		table,
-		quoteValue(fmt.Sprintf(S3URITemplate, t.S3.Bucket, key)),
+		quoteLiteral(fmt.Sprintf(S3URITemplate, t.S3.Bucket, key)),
 		cred.RedshiftCredential(),
 		t.S3.Region,
-		t.SQLOption,
+		t.CopyOptionSQL(),
+	)
+	return query, nil
+}
+
+// CopyOptionSQL returns the options of COPY rendered from copy, followed by sql_option.
+func (t *Target) CopyOptionSQL() string {
+	if t.Copy == nil {
+		return t.SQLOption
+	}
+	return strings.TrimSpace(t.Copy.SQL() + " " + t.SQLOption)
+}
+
+func (t *Target) BuildDeleteSQL(capture *[]string) (string, error) {
+	if t.OnRemove == nil || t.OnRemove.Where == "" {
+		return "", fmt.Errorf("target.on_remove.where is not defined")
+	}
+	// captured values are embedded in the WHERE clause, so escape quotes and backslashes in them
+	escaped := make([]string, len(*capture))
+	for i, v := range *capture {
+		escaped[i] = escapeLiteral(v)
+	}
+	table, err := t.tableName(capture, nil)
+	if err != nil {
+		return "", err
+	}
+	query := fmt.Sprintf(
+		DeleteSQLTemplate,
+		table,
+		expandPlaceHolder(t.OnRemove.Where, &escaped),
 	)
 	return query, nil
 }
 
+// BuildStatements returns the query with sql_before and sql_after of the target. They are executed in a transaction.
+func (t *Target) BuildStatements(record *EventRecord, capture *[]string, query string) ([]string, error) {
+	if len(t.SQLBefore) == 0 && len(t.SQLAfter) == 0 {
+		return []string{query}, nil
+	}
+	// captured values and attributes are embedded in the statements, so escape quotes and backslashes in them
+	escaped := make([]string, len(*capture))
+	for i, v := range *capture {
+		escaped[i] = escapeLiteral(v)
+	}
+	var attrs *ObjectAttributes
+	if record != nil {
+		attrs = record.Attributes.quoted()
+	}
+	stmts := make([]string, 0, len(t.SQLBefore)+len(t.SQLAfter)+1)
+	for _, q := range t.SQLBefore {
+		s, err := expandAttributes(expandPlaceHolder(q, &escaped), attrs)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+	}
+	stmts = append(stmts, query)
+	for _, q := range t.SQLAfter {
+		s, err := expandAttributes(expandPlaceHolder(q, &escaped), attrs)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+	}
+	return stmts, nil
+}
+
 type S3 struct {
-	Region    string `yaml:"region"`
-	Bucket    string `yaml:"bucket"`
-	KeyPrefix string `yaml:"key_prefix"`
-	KeyRegexp string `yaml:"key_regexp"`
+	Region     string   `yaml:"region"`
+	Bucket     string   `yaml:"bucket"`
+	KeyPrefix  string   `yaml:"key_prefix"`
+	KeySuffix  string   `yaml:"key_suffix"`
+	KeyGlob    string   `yaml:"key_glob"`
+	KeyRegexp  string   `yaml:"key_regexp"`
+	Exclude    []string `yaml:"exclude"`
+	MinSize    int64    `yaml:"min_size"`
+	MaxSize    int64    `yaml:"max_size"`
+	AllowEmpty bool     `yaml:"allow_empty"`
+
+	Metadata map[string]string `yaml:"metadata"`
+	Tags     map[string]string `yaml:"tags"`
+}
+
+func (s3 S3) hasKeyMatcher() bool {
+	return s3.KeyPrefix != "" || s3.KeySuffix != "" || s3.KeyGlob != "" || s3.KeyRegexp != ""
 }
 
 func (s3 S3) String() string {
-	if s3.KeyPrefix != "" {
-		return fmt.Sprintf(S3URITemplate, s3.Bucket, s3.KeyPrefix)
+	var pattern string
+	if s3.KeyGlob != "" {
+		pattern = s3.KeyGlob
+	} else if s3.KeyPrefix != "" {
+		pattern = s3.KeyPrefix
 	} else {
-		return fmt.Sprintf(S3URITemplate, s3.Bucket, s3.KeyRegexp)
+		pattern = s3.KeyRegexp
+	}
+	if s3.KeySuffix != "" {
+		pattern = pattern + "*" + s3.KeySuffix
 	}
+	return fmt.Sprintf(S3URITemplate, s3.Bucket, pattern)
 }
 
 type Redshift struct {
@@ -186,12 +447,124 @@ type Redshift struct {
 	Schema           string `yaml:"schema"`
 	Table            string `yaml:"table"`
 	ReconnectOnError *bool  `yaml:"reconnect_on_error"`
+
+	// temporary credentials for postgres driver
+	ClusterIdentifier string   `yaml:"cluster_identifier"`
+	IAMIdentity       bool     `yaml:"iam_identity"`
+	DurationSeconds   int32    `yaml:"duration_seconds"`
+	AutoCreate        *bool    `yaml:"auto_create"`
+	DbGroups          []string `yaml:"db_groups"`
+
+	// duration before the expiration of temporary credentials to refresh them (default 1m)
+	CredentialsRefreshMargin string `yaml:"credentials_refresh_margin"`
+
+	// throttling
+	MaxConcurrentCopies int   `yaml:"max_concurrent_copies"`
+	LockTable           *bool `yaml:"lock_table"`
+
+	// connection pool
+	MaxOpenConns    int    `yaml:"max_open_conns"`
+	MaxIdleConns    int    `yaml:"max_idle_conns"`
+	ConnMaxLifetime string `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime string `yaml:"conn_max_idle_time"`
+
+	connMaxLifetime          time.Duration
+	connMaxIdleTime          time.Duration
+	credentialsRefreshMargin time.Duration
+}
+
+const defaultCredentialsRefreshMargin = time.Minute
+
+const (
+	CredentialsAPIGetClusterCredentials        = "GetClusterCredentials"
+	CredentialsAPIGetClusterCredentialsWithIAM = "GetClusterCredentialsWithIAM"
+	CredentialsAPIGetCredentials               = "GetCredentials"
+)
+
+// CredentialsAPI returns the name of API to get temporary credentials for postgres driver.
+// It is empty when the password is defined or the driver manages credentials by itself.
+func (r Redshift) CredentialsAPI() string {
+	if r.Driver != DriverPostgres || r.Password != "" {
+		return ""
+	}
+	switch {
+	case r.Workgroup != "":
+		return CredentialsAPIGetCredentials
+	case r.IAMIdentity:
+		return CredentialsAPIGetClusterCredentialsWithIAM
+	default:
+		return CredentialsAPIGetClusterCredentials
+	}
+}
+
+// ClusterID returns cluster_identifier, or the first label of the host when it is not defined.
+func (r Redshift) ClusterID() string {
+	if r.ClusterIdentifier != "" {
+		return r.ClusterIdentifier
+	}
+	return strings.SplitN(r.Host, ".", 2)[0]
+}
+
+func (r *Redshift) setup() error {
+	if r.MaxConcurrentCopies < 0 {
+		return fmt.Errorf("redshift.max_concurrent_copies must not be negative")
+	}
+	if r.DurationSeconds != 0 && (r.DurationSeconds < 900 || r.DurationSeconds > 3600) {
+		return fmt.Errorf("redshift.duration_seconds must be between 900 and 3600")
+	}
+	if api := r.CredentialsAPI(); api != CredentialsAPIGetClusterCredentials && (r.AutoCreate != nil || len(r.DbGroups) > 0) {
+		return fmt.Errorf("redshift.auto_create and db_groups are available only for GetClusterCredentials")
+	}
+	if r.Workgroup != "" && r.IAMIdentity {
+		return fmt.Errorf("redshift.iam_identity is not available for serverless workgroups, which always use IAM identity")
+	}
+	return r.setupPool()
 }
 
+func (r *Redshift) setupPool() error {
+	if r.MaxOpenConns < 0 || r.MaxIdleConns < 0 {
+		return fmt.Errorf("redshift.max_open_conns and max_idle_conns must not be negative")
+	}
+	var err error
+	if r.ConnMaxLifetime != "" {
+		if r.connMaxLifetime, err = time.ParseDuration(r.ConnMaxLifetime); err != nil {
+			return fmt.Errorf("invalid redshift.conn_max_lifetime: %w", err)
+		}
+	}
+	if r.ConnMaxIdleTime != "" {
+		if r.connMaxIdleTime, err = time.ParseDuration(r.ConnMaxIdleTime); err != nil {
+			return fmt.Errorf("invalid redshift.conn_max_idle_time: %w", err)
+		}
+	}
+	r.credentialsRefreshMargin = defaultCredentialsRefreshMargin
+	if r.CredentialsRefreshMargin != "" {
+		if r.credentialsRefreshMargin, err = time.ParseDuration(r.CredentialsRefreshMargin); err != nil {
+			return fmt.Errorf("invalid redshift.credentials_refresh_margin: %w", err)
+		}
+		// temporary credentials are valid for 15 minutes at least
+		if r.credentialsRefreshMargin < 0 || r.credentialsRefreshMargin >= 15*time.Minute {
+			return fmt.Errorf("redshift.credentials_refresh_margin must be between 0 and 15m")
+		}
+	}
+	return nil
+}
+
+// Identity returns the key of the connection pool. Targets share a pool only when they have the same credentials and pool settings.
+// The credentials and settings are hashed, so it does not contain the password.
+func (r Redshift) Identity() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %v %d %v %q %d %d %s %s %s",
+		r.Password, r.ClusterIdentifier, r.IAMIdentity, r.DurationSeconds, BoolValue(r.AutoCreate), r.DbGroups,
+		r.MaxOpenConns, r.MaxIdleConns, r.connMaxLifetime, r.connMaxIdleTime, r.credentialsRefreshMargin,
+	)
+	return r.VisibleDSN() + "#" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// UseTransaction reports whether statements of an import run in a transaction.
+//
+// Deprecated: the postgres driver runs them by BEGIN/COMMIT, and the redshift-data driver by BatchExecuteStatement.
 func (r Redshift) UseTransaction() bool {
-	// redshift-data driver does not support transaction
-	// https://github.com/mashiike/redshift-data-sql-driver#unsupported-features
-	return r.Driver == DriverPostgres
+	return r.Driver == DriverPostgres || r.Driver == DriverRedshiftData
 }
 
 func (r Redshift) DSN() string {
@@ -239,10 +612,14 @@ func (r Redshift) VisibleDSN() string {
 }
 
 func (r Redshift) String() string {
+	return fmt.Sprintf("%s/%s", r.VisibleDSN(), r.TableString())
+}
+
+func (r Redshift) TableString() string {
 	if r.Schema == "" {
-		return fmt.Sprintf("%s/public.%s", r.VisibleDSN(), r.Table)
+		return fmt.Sprintf("public.%s", r.Table)
 	} else {
-		return fmt.Sprintf("%s/%s.%s", r.VisibleDSN(), r.Schema, r.Table)
+		return fmt.Sprintf("%s.%s", r.Schema, r.Table)
 	}
 }
 
@@ -330,6 +707,31 @@ func LoadConfig(ctx context.Context, path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = (&c).setupQueues()
+	if err != nil {
+		return nil, err
+	}
+	if c.RedshiftData == nil {
+		c.RedshiftData = &RedshiftDataOption{}
+	}
+	if err := c.RedshiftData.setup(); err != nil {
+		return nil, err
+	}
+	for _, n := range c.Notifiers {
+		if err := n.setup(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Audit != nil {
+		if err := c.Audit.setup(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Admin != nil {
+		if err := c.Admin.setup(); err != nil {
+			return nil, err
+		}
+	}
 	return &c, (&c).validate()
 }
 
@@ -340,84 +742,325 @@ func (c *Config) validate() error {
 	default:
 		return fmt.Errorf("invalid redshift.driver must be %s or %s", DriverPostgres, DriverRedshiftData)
 	}
-	if c.QueueName == "" {
+	if len(c.Queues) == 0 {
 		if !isLambda() {
-			return fmt.Errorf("queue_name required")
+			return fmt.Errorf("queue_name or queues required")
+		}
+		if len(c.Targets) == 0 {
+			return fmt.Errorf("no targets defined")
 		}
 	}
-	if len(c.Targets) == 0 {
-		return fmt.Errorf("no targets defined")
+	names := make(map[string]bool, len(c.Queues))
+	for _, q := range c.Queues {
+		if q.Name == "" {
+			return fmt.Errorf("queues.name required")
+		}
+		if names[q.Name] {
+			return fmt.Errorf("queue %s is defined twice", q.Name)
+		}
+		names[q.Name] = true
+		if len(q.targets) == 0 {
+			return fmt.Errorf("no targets defined for queue %s", q.Name)
+		}
+		if q.Workers < 1 {
+			return fmt.Errorf("queue %s: workers must be greater than 0", q.Name)
+		}
+		if q.BatchSize < 1 || q.BatchSize > 10 {
+			return fmt.Errorf("queue %s: batch_size must be between 1 and 10", q.Name)
+		}
+		if q.WaitTimeSeconds < 0 || q.WaitTimeSeconds > 20 {
+			return fmt.Errorf("queue %s: wait_time_seconds must be between 0 and 20", q.Name)
+		}
+		if q.MaxInFlight < 0 {
+			return fmt.Errorf("queue %s: max_in_flight must not be negative", q.Name)
+		}
+		if q.MaxReceiveCount < 0 {
+			return fmt.Errorf("queue %s: max_receive_count must not be negative", q.Name)
+		}
+		switch q.Defer {
+		case DeferVisibility:
+		case DeferRequeue:
+			if q.IsFIFO() {
+				return fmt.Errorf("queue %s: defer %s is not available for FIFO queues", q.Name, DeferRequeue)
+			}
+		default:
+			return fmt.Errorf("queue %s: defer must be %s or %s", q.Name, DeferVisibility, DeferRequeue)
+		}
 	}
 	return nil
 }
 
-func (c *Config) merge() error {
-	cr := c.Redshift
-	cs := c.S3
-	for _, t := range c.Targets {
-		if t.SQLOption == "" {
-			t.SQLOption = c.SQLOption
+// setupQueues converts queue_name to a queue and resolves targets for each queue.
+func (c *Config) setupQueues() error {
+	if c.QueueName != "" {
+		if len(c.Queues) > 0 {
+			return fmt.Errorf("queue_name and queues are exclusive")
 		}
-		tr := t.Redshift
-		if tr == nil {
-			t.Redshift = cr
-		} else {
-			if tr.Host == "" {
-				tr.Host = cr.Host
-			}
-			if tr.Port == 0 {
-				tr.Port = cr.Port
-			}
-			if tr.DBName == "" {
-				tr.DBName = cr.DBName
-			}
-			if tr.User == "" {
-				tr.User = cr.User
-			}
-			if tr.Password == "" {
-				tr.Password = cr.Password
-			}
-			if tr.Schema == "" {
-				tr.Schema = cr.Schema
-			}
-			if tr.Table == "" {
-				tr.Table = cr.Table
-			}
-			if tr.ReconnectOnError == nil {
-				tr.ReconnectOnError = cr.ReconnectOnError
-			}
-			if tr.Driver == "" {
-				tr.Driver = cr.Driver
-			}
-			if tr.Workgroup == "" {
-				tr.Workgroup = cr.Workgroup
+		c.Queues = []*Queue{{Name: c.QueueName}}
+	}
+	for _, q := range c.Queues {
+		if q.Workers == 0 {
+			q.Workers = 1
+		}
+		if q.BatchSize == 0 {
+			q.BatchSize = 1
+		}
+		if q.Defer == "" {
+			q.Defer = DeferVisibility
+		}
+		switch {
+		case len(q.Targets) > 0:
+			if q.TargetTag != "" {
+				return fmt.Errorf("queue %s: targets and target_tag are exclusive", q.Name)
 			}
-			if tr.Cluster == "" {
-				tr.Cluster = cr.Cluster
+			q.targets = q.Targets
+		case q.TargetTag != "":
+			for _, t := range c.Targets {
+				for _, tag := range t.Tags {
+					if tag == q.TargetTag {
+						q.targets = append(q.targets, t)
+						break
+					}
+				}
 			}
+		default:
+			q.targets = c.Targets
+		}
+	}
+	return nil
+}
+
+// QueueByName returns the queue which has the name.
+func (c *Config) QueueByName(name string) *Queue {
+	for _, q := range c.Queues {
+		if q.Name == name {
+			return q
 		}
+	}
+	return nil
+}
 
-		ts := t.S3
-		if ts == nil {
-			t.S3 = cs
-		} else {
-			if ts.Bucket == "" {
-				ts.Bucket = cs.Bucket
-			}
-			if ts.Region == "" {
-				ts.Region = cs.Region
-			}
-			if ts.KeyPrefix == "" {
-				ts.KeyPrefix = cs.KeyPrefix
+func (c *Config) merge() error {
+	if err := c.Redshift.setup(); err != nil {
+		return err
+	}
+	for _, t := range c.Targets {
+		if err := c.mergeTarget(t); err != nil {
+			return err
+		}
+	}
+	for _, q := range c.Queues {
+		for _, t := range q.Targets {
+			if err := c.mergeTarget(t); err != nil {
+				return err
 			}
-			if ts.KeyRegexp == "" {
-				ts.KeyRegexp = cs.KeyRegexp
+		}
+	}
+	return c.validateThrottle()
+}
+
+// validateThrottle checks that targets which connect to the same DSN share max_concurrent_copies, because they share the semaphore.
+func (c *Config) validateThrottle() error {
+	copies := make(map[string]int)
+	check := func(t *Target) error {
+		dsn := t.Redshift.VisibleDSN()
+		if n, ok := copies[dsn]; ok && n != t.Redshift.MaxConcurrentCopies {
+			return fmt.Errorf("target %s: redshift.max_concurrent_copies %d conflicts with %d of other targets for %s", t, t.Redshift.MaxConcurrentCopies, n, dsn)
+		}
+		copies[dsn] = t.Redshift.MaxConcurrentCopies
+		return nil
+	}
+	for _, t := range c.Targets {
+		if err := check(t); err != nil {
+			return err
+		}
+	}
+	for _, q := range c.Queues {
+		for _, t := range q.Targets {
+			if err := check(t); err != nil {
+				return err
 			}
 		}
-		err := t.buildKeyMatcher()
-		if err != nil {
+	}
+	return nil
+}
+
+func (c *Config) mergeTarget(t *Target) error {
+	cr := c.Redshift
+	cs := c.S3
+	if t.SQLOption == "" {
+		t.SQLOption = c.SQLOption
+	}
+	if t.Copy == nil {
+		t.Copy = c.Copy
+	}
+	if t.Type == "" {
+		t.Type = TypeRedshift
+	}
+	tr := t.Redshift
+	if tr == nil {
+		t.Redshift = cr
+	} else {
+		if tr.Host == "" {
+			tr.Host = cr.Host
+		}
+		if tr.Port == 0 {
+			tr.Port = cr.Port
+		}
+		if tr.DBName == "" {
+			tr.DBName = cr.DBName
+		}
+		if tr.User == "" {
+			tr.User = cr.User
+		}
+		if tr.Password == "" {
+			tr.Password = cr.Password
+		}
+		if tr.Schema == "" {
+			tr.Schema = cr.Schema
+		}
+		if tr.Table == "" {
+			tr.Table = cr.Table
+		}
+		if tr.ReconnectOnError == nil {
+			tr.ReconnectOnError = cr.ReconnectOnError
+		}
+		if tr.Driver == "" {
+			tr.Driver = cr.Driver
+		}
+		if tr.Workgroup == "" {
+			tr.Workgroup = cr.Workgroup
+		}
+		if tr.Cluster == "" {
+			tr.Cluster = cr.Cluster
+		}
+		if tr.MaxOpenConns == 0 {
+			tr.MaxOpenConns = cr.MaxOpenConns
+		}
+		if tr.MaxIdleConns == 0 {
+			tr.MaxIdleConns = cr.MaxIdleConns
+		}
+		if tr.ConnMaxLifetime == "" {
+			tr.ConnMaxLifetime = cr.ConnMaxLifetime
+		}
+		if tr.ConnMaxIdleTime == "" {
+			tr.ConnMaxIdleTime = cr.ConnMaxIdleTime
+		}
+		if tr.MaxConcurrentCopies == 0 {
+			tr.MaxConcurrentCopies = cr.MaxConcurrentCopies
+		}
+		if tr.LockTable == nil {
+			tr.LockTable = cr.LockTable
+		}
+		if tr.ClusterIdentifier == "" {
+			tr.ClusterIdentifier = cr.ClusterIdentifier
+		}
+		if !tr.IAMIdentity {
+			tr.IAMIdentity = cr.IAMIdentity
+		}
+		if tr.DurationSeconds == 0 {
+			tr.DurationSeconds = cr.DurationSeconds
+		}
+		if tr.AutoCreate == nil {
+			tr.AutoCreate = cr.AutoCreate
+		}
+		if tr.DbGroups == nil {
+			tr.DbGroups = cr.DbGroups
+		}
+		if tr.CredentialsRefreshMargin == "" {
+			tr.CredentialsRefreshMargin = cr.CredentialsRefreshMargin
+		}
+		if err := tr.setup(); err != nil {
 			return err
 		}
 	}
+
+	ts := t.S3
+	if ts == nil {
+		t.S3 = cs
+	} else {
+		if ts.Bucket == "" {
+			ts.Bucket = cs.Bucket
+		}
+		if ts.Region == "" {
+			ts.Region = cs.Region
+		}
+		// key matchers are combined, so inherit them only when the target has nothing
+		if !ts.hasKeyMatcher() {
+			ts.KeyPrefix = cs.KeyPrefix
+			ts.KeySuffix = cs.KeySuffix
+			ts.KeyGlob = cs.KeyGlob
+			ts.KeyRegexp = cs.KeyRegexp
+		}
+		if ts.Exclude == nil {
+			ts.Exclude = cs.Exclude
+		}
+		if ts.MinSize == 0 {
+			ts.MinSize = cs.MinSize
+		}
+		if ts.MaxSize == 0 {
+			ts.MaxSize = cs.MaxSize
+		}
+		if !ts.AllowEmpty {
+			ts.AllowEmpty = cs.AllowEmpty
+		}
+		if ts.Metadata == nil {
+			ts.Metadata = cs.Metadata
+		}
+		if ts.Tags == nil {
+			ts.Tags = cs.Tags
+		}
+	}
+	err := t.buildKeyMatcher()
+	if err != nil {
+		return err
+	}
+	if err := t.buildEventMatcher(); err != nil {
+		return err
+	}
+	if t.OnRemove != nil && t.OnRemove.Where == "" {
+		return fmt.Errorf("target.on_remove.where is required")
+	}
+	if err := t.buildAttributeMatcher(); err != nil {
+		return err
+	}
+	if t.RateLimit < 0 || t.RateBurst < 0 {
+		return fmt.Errorf("target.rate_limit and rate_burst must not be negative")
+	}
+	if err := t.validateObjectActions(); err != nil {
+		return err
+	}
+	if err := t.Copy.validate(); err != nil {
+		return err
+	}
+	if err := t.validateColumns(); err != nil {
+		return err
+	}
+	if (len(t.SQLBefore) > 0 || len(t.SQLAfter) > 0) && t.Type != TypeRedshift {
+		return fmt.Errorf("target.sql_before and sql_after are available only for %s targets", TypeRedshift)
+	}
+	if t.CreateTable != nil && t.Type != TypeRedshift {
+		return fmt.Errorf("target.create_table is available only for %s targets", TypeRedshift)
+	}
+	if err := t.CreateTable.setup(); err != nil {
+		return err
+	}
+	if t.SchemaDrift != nil && t.Type != TypeRedshift {
+		return fmt.Errorf("target.schema_drift is available only for %s targets", TypeRedshift)
+	}
+	if err := t.SchemaDrift.setup(); err != nil {
+		return err
+	}
+	if t.SchemaDrift != nil {
+		if err := t.validateSchemaDriftFormat(); err != nil {
+			return err
+		}
+	}
+	if t.schedule, err = parseCrons("schedule", t.Schedule); err != nil {
+		return err
+	}
+	if t.blackout, err = parseCrons("blackout", t.Blackout); err != nil {
+		return err
+	}
 	return nil
 }
@@ -3,6 +3,7 @@ package rin_test
 import (
 	"context"
 	"os"
+	"strings"
 	"testing"
 
 	rin "github.com/fujiwara/Rin"
@@ -12,6 +13,36 @@ var BrokenConfig = []string{
 	"test/config.yml.invalid_regexp",
 	"test/config.yml.no_key_matcher",
 	"test/config.yml.not_found",
+	"test/config.yml.on_remove_without_where",
+	"test/config.yml.glob_and_regexp",
+	"test/config.yml.invalid_size",
+	"test/config.yml.queue_name_and_queues",
+	"test/config.yml.invalid_conn_max_lifetime",
+	"test/config.yml.invalid_refresh_margin",
+	"test/config.yml.conflicting_max_concurrent_copies",
+	"test/config.yml.invalid_duration_seconds",
+	"test/config.yml.iam_identity_and_db_groups",
+	"test/config.yml.empty_on_success",
+	"test/config.yml.on_failure_delete",
+	"test/config.yml.on_success_delete_and_on_remove",
+	"test/config.yml.copy_to_itself",
+	"test/config.yml.invalid_notifier",
+	"test/config.yml.invalid_notifier_interval",
+	"test/config.yml.invalid_audit",
+	"test/config.yml.invalid_create_table",
+	"test/config.yml.create_table_with_capture",
+	"test/config.yml.invalid_schema_drift",
+	"test/config.yml.schema_drift_with_csv",
+	"test/config.yml.schema_drift_with_sql_option_csv",
+	"test/config.yml.schema_drift_with_sql_option_avro",
+	"test/config.yml.schema_drift_with_jsonpaths",
+	"test/config.yml.schema_drift_without_json",
+	"test/config.yml.invalid_copy",
+	"test/config.yml.invalid_admin",
+	"test/config.yml.invalid_blackout",
+	"test/config.yml.invalid_defer",
+	"test/config.yml.duplicated_columns",
+	"test/config.yml.stream_with_sql_before",
 }
 
 type testExpected struct {
@@ -197,3 +228,326 @@ func testConfig(t *testing.T, name string, expected testExpected) {
 		}
 	}
 }
+
+func TestEventNames(t *testing.T) {
+	ctx := context.Background()
+	config, err := rin.LoadConfig(ctx, "test/config.on_remove.yml")
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	tests := []struct {
+		eventName string
+		key       string
+		target    int
+		sql       string
+	}{
+		{"ObjectCreated:Put", "logs/app/dt=2022-11-01/a.json", 0, `/* Rin */ COPY "logs"."app" FROM 's3://test.bucket.test/logs/app/dt=2022-11-01/a.json' CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/rin' REGION 'ap-northeast-1' JSON 'auto' GZIP`},
+		{"ObjectRemoved:Delete", "logs/app/dt=2022-11-01/a.json", 0, `/* Rin */ DELETE FROM "logs"."app" WHERE dt = '2022-11-01'`},
+		{"ObjectCreated:Put", "foo/a.json", 1, `/* Rin */ COPY "foo" FROM 's3://test.bucket.test/foo/a.json' CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/rin' REGION 'ap-northeast-1' JSON 'auto' GZIP`},
+		{"ObjectCreated:Copy", "foo/a.json", -1, ""},
+		{"ObjectRemoved:Delete", "foo/a.json", -1, ""},
+		{"ObjectRemoved:DeleteMarkerCreated", "bar/a.json", -1, ""},
+	}
+	for _, tt := range tests {
+		record := &rin.EventRecord{EventName: tt.eventName}
+		record.S3.Bucket.Name = "test.bucket.test"
+		record.S3.Object.Key = tt.key
+		record.S3.Object.Size = 100
+		matched := -1
+		var sql string
+		for i, target := range config.Targets {
+			ok, cap := target.MatchEventRecord(record)
+			if !ok {
+				continue
+			}
+			matched = i
+			if record.IsObjectRemoved() {
+				sql, err = target.BuildDeleteSQL(cap)
+			} else {
+				sql, err = target.BuildCopySQL(tt.key, config.Credentials, cap)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			break
+		}
+		if matched != tt.target {
+			t.Errorf("%s %s: unexpected target expected %d got %d", tt.eventName, tt.key, tt.target, matched)
+		}
+		if sql != tt.sql {
+			t.Errorf("unexpected SQL:\nExpected:%s\nGot:%s", tt.sql, sql)
+		}
+	}
+}
+
+func TestBuildDeleteSQLEscape(t *testing.T) {
+	config, err := rin.LoadConfig(context.Background(), "test/config.on_remove.yml")
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	// a backslash must not escape the doubled quote
+	sql, err := config.Targets[0].BuildDeleteSQL(&[]string{"", "app", `2022\' OR 1=1 --`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `/* Rin */ DELETE FROM "logs"."app" WHERE dt = '2022\\'' OR 1=1 --'`; sql != expected {
+		t.Errorf("unexpected SQL:\nExpected:%s\nGot:%s", expected, sql)
+	}
+}
+
+func TestKeyMatcher(t *testing.T) {
+	ctx := context.Background()
+	config, err := rin.LoadConfig(ctx, "test/config.key_matcher.yml")
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	tests := []struct {
+		key     string
+		size    int64
+		target  int
+		capture []string
+	}{
+		{"logs/app/a.json.gz", 100, 0, []string{"logs/app/a.json.gz"}},
+		{"logs/app/a.json", 100, -1, nil},
+		{"logs/_tmp/a.json.gz", 100, -1, nil},
+		{"logs/app/_tmp/x/a.json.gz", 100, -1, nil},
+		{"logs/app/a.json.gz", 1001, -1, nil},
+		{"logs/app/a.json.gz", 0, -1, nil},
+		{"events/s1/a.csv", 100, 1, []string{"events/s1/a.csv", "s1", "", "a"}},
+		{"events/s1/2022/11/a.csv", 100, 1, []string{"events/s1/2022/11/a.csv", "s1", "2022/11", "a"}},
+		{"events/a.csv", 100, -1, nil},
+		{"markers/_SUCCESS", 0, 2, []string{"markers/_SUCCESS"}},
+	}
+	for _, tt := range tests {
+		matched, capture := matchTarget(config.Targets, tt.key, tt.size)
+		if matched != tt.target {
+			t.Errorf("%s(%d): unexpected target expected %d got %d", tt.key, tt.size, tt.target, matched)
+			continue
+		}
+		if strings.Join(capture, ",") != strings.Join(tt.capture, ",") {
+			t.Errorf("%s: unexpected capture expected %v got %v", tt.key, tt.capture, capture)
+		}
+	}
+}
+
+func TestKeyMatcherInherit(t *testing.T) {
+	config, err := rin.LoadConfig(context.Background(), "test/config.key_matcher_inherit.yml")
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	tests := []struct {
+		key     string
+		target  int
+		capture []string
+	}{
+		{"access/dt=2024-01-01/a.json", 0, []string{"access/dt=2024-01-01/", "access", "2024-01-01"}},
+		{"legacy/access/dt=2024-01-01/a.json", 2, []string{"legacy/access/dt=2024-01-01/a.json"}},
+		{"both/app/a.json", 1, []string{"/app/", "app"}},
+		{"both/123/a.json", -1, nil},
+		{"other/app/a.json", -1, nil},
+	}
+	for _, tt := range tests {
+		matched, capture := matchTarget(config.Targets, tt.key, 100)
+		if matched != tt.target {
+			t.Errorf("%s: unexpected target expected %d got %d", tt.key, tt.target, matched)
+			continue
+		}
+		if strings.Join(capture, ",") != strings.Join(tt.capture, ",") {
+			t.Errorf("%s: unexpected capture expected %v got %v", tt.key, tt.capture, capture)
+		}
+	}
+}
+
+// matchTarget returns the index of the first target which matches the key and its capture, or -1.
+func matchTarget(targets []*rin.Target, key string, size int64) (int, []string) {
+	record := &rin.EventRecord{EventName: "ObjectCreated:Put"}
+	record.S3.Bucket.Name = "test.bucket.test"
+	record.S3.Object.Key = key
+	record.S3.Object.Size = size
+	for i, target := range targets {
+		if ok, cap := target.MatchEventRecord(record); ok {
+			return i, *cap
+		}
+	}
+	return -1, nil
+}
+
+func TestObjectAttributes(t *testing.T) {
+	ctx := context.Background()
+	config, err := rin.LoadConfig(ctx, "test/config.attributes.yml")
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	tests := []struct {
+		attrs  rin.ObjectAttributes
+		target int
+		sql    string
+	}{
+		{
+			rin.ObjectAttributes{
+				Metadata: map[string]string{"schema": "s1", "table": "t1"},
+				Tags:     map[string]string{},
+			},
+			0,
+			`/* Rin */ COPY "s1"."t1" FROM 's3://test.bucket.test/incoming/a.json' CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/rin' REGION 'ap-northeast-1' JSON 'auto' GZIP`,
+		},
+		{
+			rin.ObjectAttributes{
+				Metadata: map[string]string{"table": "T-1"},
+				Tags:     map[string]string{"rin-table": "t2"},
+			},
+			1,
+			`/* Rin */ COPY "t2" FROM 's3://test.bucket.test/incoming/a.json' CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/rin' REGION 'ap-northeast-1' JSON 'auto' GZIP`,
+		},
+		{
+			rin.ObjectAttributes{
+				Metadata: map[string]string{},
+				Tags:     map[string]string{},
+			},
+			-1,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		record := &rin.EventRecord{EventName: "ObjectCreated:Put"}
+		record.S3.Bucket.Name = "test.bucket.test"
+		record.S3.Object.Key = "incoming/a.json"
+		record.S3.Object.Size = 100
+		attrs := tt.attrs
+		record.Attributes = &attrs
+		matched := -1
+		var sql string
+		for i, target := range config.Targets {
+			ok, cap := target.MatchEventRecord(record)
+			if !ok {
+				continue
+			}
+			if ok, err := target.MatchObjectAttributes(ctx, nil, record); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				continue
+			}
+			matched = i
+			sql, err = target.BuildCopySQLForRecord(record, config.Credentials, cap)
+			if err != nil {
+				t.Error(err)
+			}
+			break
+		}
+		if matched != tt.target {
+			t.Errorf("%v: unexpected target expected %d got %d", tt.attrs, tt.target, matched)
+		}
+		if sql != tt.sql {
+			t.Errorf("unexpected SQL:\nExpected:%s\nGot:%s", tt.sql, sql)
+		}
+	}
+}
+
+func TestQueues(t *testing.T) {
+	ctx := context.Background()
+	config, err := rin.LoadConfig(ctx, "test/config.queues.yml")
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	tests := []struct {
+		name      string
+		workers   int
+		batchSize int32
+		fifo      bool
+		tables    []string
+	}{
+		{"rin_logs", 4, 10, false, []string{"access_log", "error_log"}},
+		{"rin_events", 1, 1, false, []string{"events"}},
+		{"rin_all", 1, 1, false, []string{"access_log", "error_log", "foo"}},
+		{"rin_ordered.fifo", 1, 10, true, []string{"error_log"}},
+	}
+	if len(config.Queues) != len(tests) {
+		t.Fatalf("unexpected queues len %d", len(config.Queues))
+	}
+	for _, tt := range tests {
+		q := config.QueueByName(tt.name)
+		if q == nil {
+			t.Errorf("queue %s not found", tt.name)
+			continue
+		}
+		if q.Workers != tt.workers || q.BatchSize != tt.batchSize {
+			t.Errorf("%s: unexpected workers %d batch_size %d", tt.name, q.Workers, q.BatchSize)
+		}
+		if q.IsFIFO() != tt.fifo {
+			t.Errorf("%s: unexpected fifo %v", tt.name, q.IsFIFO())
+		}
+		tables := []string{}
+		for _, target := range q.ResolvedTargets() {
+			tables = append(tables, target.Redshift.Table)
+		}
+		if strings.Join(tables, ",") != strings.Join(tt.tables, ",") {
+			t.Errorf("%s: unexpected targets expected %v got %v", tt.name, tt.tables, tables)
+		}
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	ctx := context.Background()
+	config, err := rin.LoadConfig(ctx, "test/config.pool.yml")
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	foo, bar := config.Targets[0].Redshift, config.Targets[1].Redshift
+	if foo.MaxOpenConns != 8 || foo.MaxIdleConns != 4 || foo.ConnMaxLifetime != "30m" || foo.ConnMaxIdleTime != "5m" {
+		t.Errorf("unexpected pool settings %#v", foo)
+	}
+	if bar.MaxOpenConns != 2 || bar.MaxIdleConns != 4 || bar.ConnMaxLifetime != "30m" {
+		t.Errorf("unexpected pool settings %#v", bar)
+	}
+	if foo.Identity() == bar.Identity() {
+		t.Errorf("identities must be different for each user %s", foo.Identity())
+	}
+	if strings.Contains(foo.Identity(), "test_pass") {
+		t.Errorf("identity must not contain the password %s", foo.Identity())
+	}
+	// targets share a pool only when they have the same credentials and settings
+	same, password, pool := *foo, *foo, *foo
+	password.Password = "other_pass"
+	pool.MaxOpenConns = 1
+	if same.Identity() != foo.Identity() {
+		t.Errorf("identities must be same %s %s", same.Identity(), foo.Identity())
+	}
+	for _, rs := range []rin.Redshift{password, pool} {
+		if rs.Identity() == foo.Identity() {
+			t.Errorf("identities must be different %s", rs.Identity())
+		}
+	}
+}
+
+func TestTemporaryCredentials(t *testing.T) {
+	ctx := context.Background()
+	config, err := rin.LoadConfig(ctx, "test/config.credentials.yml")
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	expected := []struct {
+		api       string
+		clusterID string
+	}{
+		{rin.CredentialsAPIGetClusterCredentials, "redshift"},
+		{rin.CredentialsAPIGetClusterCredentials, "mycluster"},
+		{rin.CredentialsAPIGetClusterCredentialsWithIAM, "mycluster"},
+		{rin.CredentialsAPIGetCredentials, "default"},
+		{"", "redshift"},
+	}
+	for i, target := range config.Targets {
+		rs := target.Redshift
+		if api := rs.CredentialsAPI(); api != expected[i].api {
+			t.Errorf("%s: unexpected credentials API %s expected %s", target, api, expected[i].api)
+		}
+		if id := rs.ClusterID(); id != expected[i].clusterID {
+			t.Errorf("%s: unexpected cluster ID %s expected %s", target, id, expected[i].clusterID)
+		}
+		if rs.DurationSeconds != 1800 {
+			t.Errorf("%s: duration_seconds must be inherited", target)
+		}
+	}
+	if rs := config.Targets[1].Redshift; !rin.BoolValue(rs.AutoCreate) || len(rs.DbGroups) != 1 {
+		t.Errorf("unexpected auto_create and db_groups %#v", rs)
+	}
+}
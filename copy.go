@@ -0,0 +1,167 @@
+package rin
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+	FormatAvro    = "avro"
+	FormatORC     = "orc"
+)
+
+var copyCompressions = []string{"gzip", "bzip2", "lzop", "zstd"}
+
+// CopyOptions represents structured options of COPY. They are validated at load time and rendered with quoted values.
+// sql_option of the target is appended after them as raw SQL.
+type CopyOptions struct {
+	Format             string  `yaml:"format"`
+	JSONPaths          string  `yaml:"jsonpaths"`
+	Compression        string  `yaml:"compression"`
+	Delimiter          string  `yaml:"delimiter"`
+	Quote              string  `yaml:"quote"`
+	IgnoreHeader       int     `yaml:"ignore_header"`
+	NullAs             *string `yaml:"null_as"`
+	TimeFormat         string  `yaml:"timeformat"`
+	DateFormat         string  `yaml:"dateformat"`
+	MaxError           int     `yaml:"maxerror"`
+	TruncateColumns    bool    `yaml:"truncatecolumns"`
+	BlanksAsNull       bool    `yaml:"blanks_as_null"`
+	EmptyAsNull        bool    `yaml:"empty_as_null"`
+	AcceptInvalidChars string  `yaml:"accept_invalid_chars"`
+	Manifest           bool    `yaml:"manifest"`
+}
+
+func (o *CopyOptions) isColumnar() bool {
+	return o.Format == FormatParquet || o.Format == FormatORC
+}
+
+func (o *CopyOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	o.Format = strings.ToLower(o.Format)
+	switch o.Format {
+	case "", FormatJSON, FormatCSV, FormatParquet, FormatAvro, FormatORC:
+	default:
+		return fmt.Errorf("copy.format must be %s, %s, %s, %s or %s", FormatJSON, FormatCSV, FormatParquet, FormatAvro, FormatORC)
+	}
+	if o.JSONPaths != "" {
+		if o.Format != FormatJSON && o.Format != FormatAvro {
+			return fmt.Errorf("copy.jsonpaths is available only for %s and %s", FormatJSON, FormatAvro)
+		}
+		if p := strings.ToLower(o.JSONPaths); p != "auto" && p != "auto ignorecase" && !strings.HasPrefix(o.JSONPaths, "s3://") {
+			return fmt.Errorf("copy.jsonpaths must be auto, auto ignorecase or s3://bucket/key")
+		}
+	}
+	if o.isColumnar() {
+		if o.Compression != "" || o.Delimiter != "" || o.Quote != "" || o.IgnoreHeader != 0 || o.NullAs != nil ||
+			o.TimeFormat != "" || o.DateFormat != "" || o.MaxError != 0 || o.TruncateColumns ||
+			o.BlanksAsNull || o.EmptyAsNull || o.AcceptInvalidChars != "" {
+			return fmt.Errorf("copy.format %s accepts only manifest", o.Format)
+		}
+		return nil
+	}
+	if o.Compression != "" {
+		o.Compression = strings.ToLower(o.Compression)
+		if !containsString(copyCompressions, o.Compression) {
+			return fmt.Errorf("copy.compression must be one of %s", strings.Join(copyCompressions, ", "))
+		}
+	}
+	if o.Delimiter != "" {
+		if o.Format != "" && o.Format != FormatCSV {
+			return fmt.Errorf("copy.delimiter is available only for %s or text format", FormatCSV)
+		}
+		if len(o.Delimiter) != 1 {
+			return fmt.Errorf("copy.delimiter must be a single ASCII character")
+		}
+	}
+	if o.Quote != "" {
+		if o.Format != FormatCSV {
+			return fmt.Errorf("copy.quote is available only for %s", FormatCSV)
+		}
+		if len(o.Quote) != 1 {
+			return fmt.Errorf("copy.quote must be a single ASCII character")
+		}
+	}
+	if o.IgnoreHeader < 0 || o.MaxError < 0 {
+		return fmt.Errorf("copy.ignore_header and maxerror must not be negative")
+	}
+	if o.IgnoreHeader > 0 && o.Format != "" && o.Format != FormatCSV {
+		return fmt.Errorf("copy.ignore_header is available only for %s or text format", FormatCSV)
+	}
+	if len(o.AcceptInvalidChars) > 1 {
+		return fmt.Errorf("copy.accept_invalid_chars must be a single ASCII character")
+	}
+	return nil
+}
+
+// SQL renders the options. Values are quoted as string literals.
+func (o *CopyOptions) SQL() string {
+	if o == nil {
+		return ""
+	}
+	var opts []string
+	switch o.Format {
+	case FormatJSON, FormatAvro:
+		p := o.JSONPaths
+		if p == "" {
+			p = "auto"
+		}
+		opts = append(opts, "FORMAT AS "+strings.ToUpper(o.Format)+" "+quoteValue(p))
+	case FormatCSV, FormatParquet, FormatORC:
+		opts = append(opts, "FORMAT AS "+strings.ToUpper(o.Format))
+	}
+	if o.Quote != "" {
+		opts = append(opts, "QUOTE AS "+quoteValue(o.Quote))
+	}
+	if o.Delimiter != "" {
+		opts = append(opts, "DELIMITER "+quoteValue(o.Delimiter))
+	}
+	if o.Compression != "" {
+		opts = append(opts, strings.ToUpper(o.Compression))
+	}
+	if o.Manifest {
+		opts = append(opts, "MANIFEST")
+	}
+	if o.IgnoreHeader > 0 {
+		opts = append(opts, fmt.Sprintf("IGNOREHEADER %d", o.IgnoreHeader))
+	}
+	if o.NullAs != nil {
+		opts = append(opts, "NULL AS "+quoteValue(*o.NullAs))
+	}
+	if o.BlanksAsNull {
+		opts = append(opts, "BLANKSASNULL")
+	}
+	if o.EmptyAsNull {
+		opts = append(opts, "EMPTYASNULL")
+	}
+	if o.TimeFormat != "" {
+		opts = append(opts, "TIMEFORMAT "+quoteValue(o.TimeFormat))
+	}
+	if o.DateFormat != "" {
+		opts = append(opts, "DATEFORMAT "+quoteValue(o.DateFormat))
+	}
+	if o.AcceptInvalidChars != "" {
+		opts = append(opts, "ACCEPTINVCHARS AS "+quoteValue(o.AcceptInvalidChars))
+	}
+	if o.TruncateColumns {
+		opts = append(opts, "TRUNCATECOLUMNS")
+	}
+	if o.MaxError > 0 {
+		opts = append(opts, fmt.Sprintf("MAXERROR %d", o.MaxError))
+	}
+	return strings.Join(opts, " ")
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
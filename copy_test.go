@@ -0,0 +1,35 @@
+package rin_test
+
+import (
+	"context"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestCopyOptions(t *testing.T) {
+	config, err := rin.LoadConfig(context.Background(), "test/config.copy.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`/* Rin */ COPY "json" FROM 's3://test.bucket.test/json/1' CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/rin' REGION 'ap-northeast-1' FORMAT AS JSON 'auto' GZIP`,
+		`/* Rin */ COPY "csv" FROM 's3://test.bucket.test/csv/1' CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/rin' REGION 'ap-northeast-1' FORMAT AS CSV QUOTE AS '''' DELIMITER '|' IGNOREHEADER 1 NULL AS '' EMPTYASNULL TIMEFORMAT 'YYYY-MM-DD HH:MI:SS'' CREDENTIALS ''x' DATEFORMAT 'auto' TRUNCATECOLUMNS MAXERROR 10 ACCEPTANYDATE`,
+		`/* Rin */ COPY "parquet" FROM 's3://test.bucket.test/parquet/1' CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/rin' REGION 'ap-northeast-1' FORMAT AS PARQUET MANIFEST`,
+		`/* Rin */ COPY "avro" FROM 's3://test.bucket.test/avro/1' CREDENTIALS 'aws_iam_role=arn:aws:iam::123456789012:role/rin' REGION 'ap-northeast-1' FORMAT AS AVRO 's3://test.bucket.test/jsonpaths/avro.json'`,
+	}
+	for i, target := range config.Targets {
+		key := target.Redshift.Table + "/1"
+		ok, capture := target.Match("test.bucket.test", key)
+		if !ok {
+			t.Fatalf("%s must match", key)
+		}
+		sql, err := target.BuildCopySQL(key, config.Credentials, capture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sql != expected[i] {
+			t.Errorf("unexpected SQL\n%s\n%s", sql, expected[i])
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package rin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+)
+
+// RedshiftDataClient is the subset of the Redshift Data API used by Rin.
+type RedshiftDataClient interface {
+	ExecuteStatement(context.Context, *redshiftdata.ExecuteStatementInput, ...func(*redshiftdata.Options)) (*redshiftdata.ExecuteStatementOutput, error)
+	BatchExecuteStatement(context.Context, *redshiftdata.BatchExecuteStatementInput, ...func(*redshiftdata.Options)) (*redshiftdata.BatchExecuteStatementOutput, error)
+	DescribeStatement(context.Context, *redshiftdata.DescribeStatementInput, ...func(*redshiftdata.Options)) (*redshiftdata.DescribeStatementOutput, error)
+	GetStatementResult(context.Context, *redshiftdata.GetStatementResultInput, ...func(*redshiftdata.Options)) (*redshiftdata.GetStatementResultOutput, error)
+}
+
+// WithRedshiftDataClient sets a Redshift Data API client. The default is created by the sessions.
+func WithRedshiftDataClient(c RedshiftDataClient) InstanceOption {
+	return func(r *Rin) {
+		r.redshiftDataSvc = c
+	}
+}
+
+// StatementError represents a statement which was failed or aborted on Redshift.
+type StatementError struct {
+	ID     string
+	Status string
+	Err    string
+	Index  int // index of the failed statement in a batch, or -1 if it is unknown
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("statement %s %s: %s", e.ID, strings.ToLower(e.Status), e.Err)
+}
+
+// TrackedStatement is a statement executing for an in-flight message.
+type TrackedStatement struct {
+	ID          string    `json:"id"`
+	MessageID   string    `json:"message_id"`
+	Target      string    `json:"target"`
+	SubmittedAt time.Time `json:"submitted_at"`
+}
+
+// statementTracker holds statements by message ID and SQL. They are saved into the state file to resume tracking after a restart.
+type statementTracker struct {
+	mu         sync.Mutex
+	path       string
+	statements map[string]*TrackedStatement
+}
+
+func newStatementTracker(path string) (*statementTracker, error) {
+	t := &statementTracker{
+		path:       path,
+		statements: make(map[string]*TrackedStatement),
+	}
+	if path == "" {
+		return t, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &t.statements); err != nil {
+		return nil, fmt.Errorf("failed to load statements from %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func statementKey(msgID string, queries []string) string {
+	h := sha256.New()
+	h.Write([]byte(msgID))
+	for _, q := range queries {
+		h.Write([]byte{0})
+		h.Write([]byte(q))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (t *statementTracker) get(key string) *TrackedStatement {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.statements[key]
+}
+
+func (t *statementTracker) put(key string, s *TrackedStatement) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.statements[key] = s
+	return t.save()
+}
+
+func (t *statementTracker) delete(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.statements[key]; !ok {
+		return nil
+	}
+	delete(t.statements, key)
+	return t.save()
+}
+
+func (t *statementTracker) list() []*TrackedStatement {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ss := make([]*TrackedStatement, 0, len(t.statements))
+	for _, s := range t.statements {
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// save writes the statements into the state file atomically. must be called with the lock.
+func (t *statementTracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(t.statements)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
+
+// TrackedStatements returns statements which are executing or were executing before the last shutdown.
+func (r *Rin) TrackedStatements() []*TrackedStatement {
+	return r.statements.list()
+}
+
+func (r *Rin) pollingInterval() time.Duration {
+	if o := r.config.RedshiftData; o != nil && o.pollingInterval > 0 {
+		return o.pollingInterval
+	}
+	return DefaultPollingInterval
+}
+
+// execDataAPI executes queries by the Redshift Data API and waits for the completion.
+// Multiple queries are executed in a transaction by BatchExecuteStatement.
+// The statement is tracked with the message ID, so a redelivered message resumes waiting for it instead of executing again.
+func (r *Rin) execDataAPI(ctx context.Context, target *Target, msgID string, queries []string, copyIndex int) (int64, error) {
+	key := statementKey(msgID, queries)
+	if msgID != "" {
+		if s := r.statements.get(key); s != nil {
+			r.logger.Printf("[info] [%s] Resume tracking statement %s submitted at %s", msgID, s.ID, s.SubmittedAt.Format(time.RFC3339))
+			res, err := r.waitStatement(ctx, s.ID)
+			if err == nil {
+				return resultRows(res, queries, copyIndex), r.statements.delete(key)
+			}
+			if !isStatementTerminated(err) {
+				return -1, err
+			}
+			r.logger.Printf("[warn] [%s] Statement %s was not completed. Execute again. %s", msgID, s.ID, err)
+			if err := r.statements.delete(key); err != nil {
+				return -1, err
+			}
+		}
+	}
+
+	for _, q := range queries {
+		r.logger.Println("[debug] SQL:", q)
+	}
+	id, err := r.executeStatement(ctx, target, queries)
+	if err != nil {
+		return -1, err
+	}
+	r.logger.Printf("[info] [%s] Submitted statement %s", msgID, id)
+	if msgID != "" {
+		s := &TrackedStatement{
+			ID:          id,
+			MessageID:   msgID,
+			Target:      target.String(),
+			SubmittedAt: time.Now(),
+		}
+		if err := r.statements.put(key, s); err != nil {
+			r.logger.Printf("[warn] [%s] Failed to save the state of statement %s. %s", msgID, id, err)
+		}
+	}
+	res, err := r.waitStatement(ctx, id)
+	if err != nil && !isStatementTerminated(err) {
+		// the statement may be still running (e.g. canceled or DescribeStatement was throttled).
+		// keep tracking to resume when the message is redelivered
+		return -1, err
+	}
+	if e := r.statements.delete(key); e != nil {
+		r.logger.Printf("[warn] [%s] Failed to save the state of statements. %s", msgID, e)
+	}
+	if err != nil {
+		return -1, err
+	}
+	return resultRows(res, queries, copyIndex), nil
+}
+
+// isStatementTerminated reports whether the statement will never complete by the error of waitStatement.
+func isStatementTerminated(err error) bool {
+	var serr *StatementError
+	var nerr *types.ResourceNotFoundException
+	return errors.As(err, &serr) || errors.As(err, &nerr)
+}
+
+// resultRows returns ResultRows of the statement at copyIndex. The Data API reports -1 when it is unknown.
+func resultRows(res *redshiftdata.DescribeStatementOutput, queries []string, copyIndex int) int64 {
+	if copyIndex < 0 || res == nil {
+		return -1
+	}
+	if len(queries) == 1 {
+		return res.ResultRows
+	}
+	if copyIndex < len(res.SubStatements) {
+		return res.SubStatements[copyIndex].ResultRows
+	}
+	return -1
+}
+
+func (r *Rin) executeStatement(ctx context.Context, target *Target, queries []string) (string, error) {
+	rs := target.Redshift
+	var cluster, dbUser, workgroup *string
+	if rs.Workgroup != "" {
+		workgroup = aws.String(rs.Workgroup)
+	} else {
+		cluster, dbUser = aws.String(rs.Cluster), aws.String(rs.User)
+	}
+	svc := r.getRedshiftDataClient()
+	if len(queries) == 1 {
+		res, err := svc.ExecuteStatement(ctx, &redshiftdata.ExecuteStatementInput{
+			Sql:               aws.String(queries[0]),
+			Database:          aws.String(rs.DBName),
+			ClusterIdentifier: cluster,
+			DbUser:            dbUser,
+			WorkgroupName:     workgroup,
+			StatementName:     aws.String("rin"),
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.ToString(res.Id), nil
+	}
+	res, err := svc.BatchExecuteStatement(ctx, &redshiftdata.BatchExecuteStatementInput{
+		Sqls:              queries,
+		Database:          aws.String(rs.DBName),
+		ClusterIdentifier: cluster,
+		DbUser:            dbUser,
+		WorkgroupName:     workgroup,
+		StatementName:     aws.String("rin"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(res.Id), nil
+}
+
+// queryDataAPI executes the query and returns values of the first column as strings. NULL is returned as an empty string.
+func (r *Rin) queryDataAPI(ctx context.Context, target *Target, query string) ([]string, error) {
+	r.logger.Println("[debug] SQL:", query)
+	id, err := r.executeStatement(ctx, target, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.waitStatement(ctx, id); err != nil {
+		return nil, err
+	}
+	svc := r.getRedshiftDataClient()
+	var values []string
+	var token *string
+	for {
+		res, err := svc.GetStatementResult(ctx, &redshiftdata.GetStatementResultInput{
+			Id:        aws.String(id),
+			NextToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range res.Records {
+			if len(record) == 0 {
+				continue
+			}
+			switch v := record[0].(type) {
+			case *types.FieldMemberStringValue:
+				values = append(values, v.Value)
+			default:
+				values = append(values, "")
+			}
+		}
+		if token = res.NextToken; token == nil || *token == "" {
+			return values, nil
+		}
+	}
+}
+
+// waitStatement polls DescribeStatement until the statement is completed.
+func (r *Rin) waitStatement(ctx context.Context, id string) (*redshiftdata.DescribeStatementOutput, error) {
+	svc := r.getRedshiftDataClient()
+	ticker := time.NewTicker(r.pollingInterval())
+	defer ticker.Stop()
+	for {
+		res, err := svc.DescribeStatement(ctx, &redshiftdata.DescribeStatementInput{
+			Id: aws.String(id),
+		})
+		if err != nil {
+			return nil, err
+		}
+		switch res.Status {
+		case types.StatusStringFinished:
+			r.logger.Printf("[info] Statement %s finished in %s", id, time.Duration(res.Duration))
+			return res, nil
+		case types.StatusStringFailed, types.StatusStringAborted:
+			serr := &StatementError{ID: id, Status: string(res.Status), Err: aws.ToString(res.Error), Index: -1}
+			for i, sub := range res.SubStatements {
+				if sub.Status == types.StatementStatusStringFailed {
+					serr.Index = i
+					break
+				}
+			}
+			return nil, serr
+		}
+		r.logger.Printf("[debug] Statement %s is %s", id, res.Status)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
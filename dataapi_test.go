@@ -0,0 +1,258 @@
+package rin_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func newDataAPITestRequest(target *rin.Target, msgID string) *rin.ImportRequest {
+	record := &rin.EventRecord{EventName: "ObjectCreated:Put"}
+	record.S3.Bucket.Name = "test.bucket.test"
+	record.S3.Object.Key = "test/foo/1.json"
+	record.S3.Object.Size = 100
+	_, capture := target.MatchEventRecord(record)
+	return &rin.ImportRequest{Target: target, Record: record, Capture: capture, MessageID: msgID}
+}
+
+func TestDataAPIImport(t *testing.T) {
+	f := &fakeRedshiftData{polls: 2, status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.dataapi.yml", rin.WithRedshiftDataClient(f))
+	target := r.Config().Targets[0]
+	if err := r.Importer(target).Import(context.Background(), newDataAPITestRequest(target, "msg1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.executed) != 1 {
+		t.Errorf("unexpected executed %v", f.executed)
+	}
+	if n := f.describe["stmt-1"]; n != 3 {
+		t.Errorf("unexpected describe count %d", n)
+	}
+	if ss := r.TrackedStatements(); len(ss) != 0 {
+		t.Errorf("statements must not be tracked after finished %v", ss)
+	}
+}
+
+func TestDataAPIFailed(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFailed}
+	r := newTestInstance(t, "test/config.dataapi.yml", rin.WithRedshiftDataClient(f))
+	target := r.Config().Targets[0]
+	err := r.Importer(target).Import(context.Background(), newDataAPITestRequest(target, "msg1"))
+	var serr *rin.StatementError
+	if !errors.As(err, &serr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if serr.ID != "stmt-1" || serr.Status != "FAILED" {
+		t.Errorf("unexpected error %#v", serr)
+	}
+	if ss := r.TrackedStatements(); len(ss) != 0 {
+		t.Errorf("statements must not be tracked after failed %v", ss)
+	}
+}
+
+func TestDataAPIResume(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "statements.json")
+
+	// shutdown while the statement is running
+	f1 := &fakeRedshiftData{polls: 1000, status: types.StatusStringFinished}
+	config1 := loadTestConfig(t, "test/config.dataapi.yml")
+	config1.RedshiftData.StateFile = stateFile
+	r1 := newTestInstanceWithConfig(t, config1, rin.WithRedshiftDataClient(f1))
+	target1 := r1.Config().Targets[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r1.Importer(target1).Import(ctx, newDataAPITestRequest(target1, "msg1")); err == nil {
+		t.Fatal("import must be canceled")
+	}
+	r1.Close()
+
+	// restart and the message is redelivered
+	f2 := &fakeRedshiftData{polls: 1, status: types.StatusStringFinished}
+	config2 := loadTestConfig(t, "test/config.dataapi.yml")
+	config2.RedshiftData.StateFile = stateFile
+	r2 := newTestInstanceWithConfig(t, config2, rin.WithRedshiftDataClient(f2))
+	target2 := r2.Config().Targets[0]
+	ss := r2.TrackedStatements()
+	if len(ss) != 1 || ss[0].ID != "stmt-1" || ss[0].MessageID != "msg1" {
+		t.Fatalf("unexpected tracked statements %v", ss)
+	}
+	if err := r2.Importer(target2).Import(context.Background(), newDataAPITestRequest(target2, "msg1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(f2.executed) != 0 {
+		t.Errorf("statement must not be executed again %v", f2.executed)
+	}
+	if f2.describe["stmt-1"] != 2 {
+		t.Errorf("statement must be resumed %v", f2.describe)
+	}
+	if ss := r2.TrackedStatements(); len(ss) != 0 {
+		t.Errorf("statements must not be tracked after finished %v", ss)
+	}
+}
+
+func TestDataAPIDescribeError(t *testing.T) {
+	f := &fakeRedshiftData{polls: 1, status: types.StatusStringFinished, describeErrors: 1}
+	r := newTestInstance(t, "test/config.dataapi.yml", rin.WithRedshiftDataClient(f))
+	target := r.Config().Targets[0]
+	if err := r.Importer(target).Import(context.Background(), newDataAPITestRequest(target, "msg1")); err == nil {
+		t.Fatal("import must be failed by DescribeStatement")
+	}
+	// the statement may be running, so it is tracked
+	if ss := r.TrackedStatements(); len(ss) != 1 || ss[0].ID != "stmt-1" {
+		t.Fatalf("unexpected tracked statements %v", ss)
+	}
+
+	// the message is redelivered
+	if err := r.Importer(target).Import(context.Background(), newDataAPITestRequest(target, "msg1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.executed) != 1 {
+		t.Errorf("statement must not be executed again %v", f.executed)
+	}
+	if ss := r.TrackedStatements(); len(ss) != 0 {
+		t.Errorf("statements must not be tracked after finished %v", ss)
+	}
+}
+
+func TestDataAPIResumeFailed(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "statements.json")
+
+	f1 := &fakeRedshiftData{polls: 1000, status: types.StatusStringFinished}
+	config1 := loadTestConfig(t, "test/config.dataapi.yml")
+	config1.RedshiftData.StateFile = stateFile
+	r1 := newTestInstanceWithConfig(t, config1, rin.WithRedshiftDataClient(f1))
+	target1 := r1.Config().Targets[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r1.Importer(target1).Import(ctx, newDataAPITestRequest(target1, "msg1"))
+	r1.Close()
+
+	// the statement was aborted while Rin was stopped, so it is executed again
+	f2 := &fakeRedshiftData{status: types.StatusStringAborted}
+	config2 := loadTestConfig(t, "test/config.dataapi.yml")
+	config2.RedshiftData.StateFile = stateFile
+	r2 := newTestInstanceWithConfig(t, config2, rin.WithRedshiftDataClient(f2))
+	target2 := r2.Config().Targets[0]
+	err := r2.Importer(target2).Import(context.Background(), newDataAPITestRequest(target2, "msg1"))
+	var serr *rin.StatementError
+	if !errors.As(err, &serr) || serr.ID != "stmt-1" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(f2.executed) != 1 {
+		t.Errorf("statement must be executed again %v", f2.executed)
+	}
+}
+
+func TestDataAPITransaction(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.dataapi.yml", rin.WithRedshiftDataClient(f))
+	target := r.Config().Targets[1]
+
+	record := &rin.EventRecord{EventName: "ObjectCreated:Put"}
+	record.S3.Bucket.Name = "test.bucket.test"
+	record.S3.Object.Key = "events/app/20221201/1.json"
+	record.S3.Object.Size = 100
+	record.Attributes = &rin.ObjectAttributes{Metadata: map[string]string{"source": "it's"}}
+	ok, capture := target.MatchEventRecord(record)
+	if !ok {
+		t.Fatal("must match")
+	}
+	req := &rin.ImportRequest{Target: target, Record: record, Capture: capture, MessageID: "msg1"}
+	if err := r.Importer(target).Import(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.executed) != 1 || len(f.executed[0]) != 3 {
+		t.Fatalf("statements must be executed in a batch %v", f.executed)
+	}
+	stmts := f.executed[0]
+	if stmts[0] != `DELETE FROM app.events WHERE dt = '20221201'` {
+		t.Errorf("unexpected sql_before %s", stmts[0])
+	}
+	if !strings.HasPrefix(stmts[1], `/* Rin */ COPY "app"."events" FROM 's3://test.bucket.test/events/app/20221201/1.json'`) {
+		t.Errorf("unexpected COPY %s", stmts[1])
+	}
+	if stmts[2] != `INSERT INTO app.ledger VALUES ('20221201', 'it''s')` {
+		t.Errorf("unexpected sql_after %s", stmts[2])
+	}
+}
+
+func TestDataAPIResultRows(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFinished, rows: 10}
+	r := newTestInstance(t, "test/config.dataapi.yml", rin.WithRedshiftDataClient(f))
+	target := r.Config().Targets[0]
+	req := newDataAPITestRequest(target, "msg1")
+	req.Result = &rin.ImportResult{}
+	if err := r.Importer(target).Import(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Result.Rows != 10 {
+		t.Errorf("unexpected rows %d", req.Result.Rows)
+	}
+
+	// the rows of the COPY statement in a batch
+	events := r.Config().Targets[1]
+	record := &rin.EventRecord{EventName: "ObjectCreated:Put"}
+	record.S3.Bucket.Name = "test.bucket.test"
+	record.S3.Object.Key = "events/app/20221201/1.json"
+	record.S3.Object.Size = 100
+	record.Attributes = &rin.ObjectAttributes{Metadata: map[string]string{"source": "test"}}
+	_, capture := events.MatchEventRecord(record)
+	req = &rin.ImportRequest{Target: events, Record: record, Capture: capture, MessageID: "msg2", Result: &rin.ImportResult{}}
+	if err := r.Importer(events).Import(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Result.Rows != 20 {
+		t.Errorf("unexpected rows in a batch %d", req.Result.Rows)
+	}
+}
+
+func TestDataAPINonEmpty(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.dataapi.yml", rin.WithRedshiftDataClient(f))
+	target := r.Config().Targets[0]
+	if err := r.Importer(target).Import(context.Background(), newDataAPITestRequest(target, "msg1")); err != nil {
+		t.Errorf("empty loads must be allowed without non_empty %s", err)
+	}
+	target.NonEmpty = true
+	err := r.Importer(target).Import(context.Background(), newDataAPITestRequest(target, "msg2"))
+	if !errors.As(err, &rin.EmptyLoadError{}) {
+		t.Errorf("unexpected error %v", err)
+	}
+	// the check runs in the batch following COPY, so the empty load is rolled back
+	if q := f.executed[len(f.executed)-1]; len(q) != 2 || !strings.Contains(q[0], "COPY") || q[1] != rin.NonEmptyCheckSQL {
+		t.Errorf("unexpected executed %v", q)
+	}
+	f.rows = -1
+	if err := r.Importer(target).Import(context.Background(), newDataAPITestRequest(target, "msg3")); err != nil {
+		t.Errorf("unknown rows must not be checked %s", err)
+	}
+}
+
+func TestDataAPINonEmptyWithHooks(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.dataapi.yml", rin.WithRedshiftDataClient(f))
+	target := r.Config().Targets[1]
+	target.NonEmpty = true
+	record := &rin.EventRecord{EventName: "ObjectCreated:Put"}
+	record.S3.Bucket.Name = "test.bucket.test"
+	record.S3.Object.Key = "events/app/20240101/1.json"
+	record.S3.Object.Size = 100
+	record.Attributes = &rin.ObjectAttributes{Metadata: map[string]string{"source": "test"}}
+	_, capture := target.MatchEventRecord(record)
+	err := r.Importer(target).Import(context.Background(), &rin.ImportRequest{Target: target, Record: record, Capture: capture, MessageID: "msg1"})
+	if !errors.As(err, &rin.EmptyLoadError{}) {
+		t.Errorf("unexpected error %v", err)
+	}
+	// sql_after follows the check in the same batch
+	q := f.executed[len(f.executed)-1]
+	if len(q) != 4 || q[2] != rin.NonEmptyCheckSQL || !strings.HasPrefix(q[3], "INSERT INTO app.ledger") {
+		t.Errorf("unexpected executed %v", q)
+	}
+}
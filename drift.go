@@ -0,0 +1,342 @@
+package rin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	SchemaDriftWarn  = "warn"
+	SchemaDriftAlter = "alter"
+
+	ColumnsSQLTemplate   = "/* Rin */ SELECT column_name FROM svv_columns WHERE table_schema = %s AND table_name = %s"
+	AddColumnSQLTemplate = "/* Rin */ ALTER TABLE %s ADD COLUMN %s %s"
+
+	DefaultSchemaDriftSample = 100
+)
+
+var (
+	// jsonAutoCopyOption matches options of COPY which load JSON objects by the names of keys.
+	jsonAutoCopyOption = regexp.MustCompile(`(?i)\bJSON\s+(AS\s+)?'auto( ignorecase)?'`)
+	// nonJSONCopyOption matches options of COPY which load other formats or objects listed in a manifest.
+	nonJSONCopyOption = regexp.MustCompile(`(?i)\b(CSV|PARQUET|ORC|AVRO|FIXEDWIDTH|SHAPEFILE|DELIMITER|MANIFEST)\b`)
+)
+
+// DefaultSchemaDriftInterval is the default interval to sample objects of a table.
+var DefaultSchemaDriftInterval = time.Minute
+
+// SchemaDrift represents detection of keys in JSON objects which are not columns of the table.
+// Keys are sampled from the first records of an object per interval for each table, and compared with svv_columns.
+type SchemaDrift struct {
+	Mode        string            `yaml:"mode"`
+	Sample      int               `yaml:"sample"`
+	Compression string            `yaml:"compression"`
+	Types       map[string]string `yaml:"types"`
+	Interval    string            `yaml:"interval"`
+
+	interval time.Duration
+}
+
+// validateSchemaDriftFormat returns an error when the target doesn't load JSON objects by 'auto', which keys of sampled records are compared with.
+// Options in copy and sql_option are checked.
+func (t *Target) validateSchemaDriftFormat() error {
+	opts := t.CopyOptionSQL()
+	if !jsonAutoCopyOption.MatchString(opts) || nonJSONCopyOption.MatchString(opts) {
+		return fmt.Errorf("target.schema_drift is available only for JSON objects loaded by 'auto' or 'auto ignorecase', but the options of COPY are %q", opts)
+	}
+	return nil
+}
+
+func (d *SchemaDrift) setup() error {
+	if d == nil {
+		return nil
+	}
+	switch d.Mode {
+	case "":
+		d.Mode = SchemaDriftWarn
+	case SchemaDriftWarn, SchemaDriftAlter:
+	default:
+		return fmt.Errorf("target.schema_drift.mode must be %s or %s", SchemaDriftWarn, SchemaDriftAlter)
+	}
+	if d.Sample < 0 {
+		return fmt.Errorf("target.schema_drift.sample must not be negative")
+	} else if d.Sample == 0 {
+		d.Sample = DefaultSchemaDriftSample
+	}
+	if d.Compression == "" {
+		d.Compression = CompressionAuto
+	}
+	switch d.Compression {
+	case CompressionAuto, CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("target.schema_drift.compression must be %s, %s, %s or %s", CompressionAuto, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+	for kind := range d.Types {
+		if _, ok := DefaultJSONColumnTypes[kind]; !ok {
+			return fmt.Errorf("target.schema_drift.types has unknown kind %s", kind)
+		}
+	}
+	d.interval = DefaultSchemaDriftInterval
+	if d.Interval != "" {
+		i, err := time.ParseDuration(d.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid target.schema_drift.interval: %w", err)
+		}
+		if i < 0 {
+			return fmt.Errorf("target.schema_drift.interval must not be negative")
+		}
+		d.interval = i
+	}
+	return nil
+}
+
+func (d *SchemaDrift) columnType(kind string) string {
+	if t, ok := d.Types[kind]; ok {
+		return t
+	}
+	return DefaultJSONColumnTypes[kind]
+}
+
+// JSONKey is a key of JSON objects and the kind of the first non-null value.
+type JSONKey struct {
+	Name string
+	Kind string
+}
+
+// SampleJSONKeys returns keys of JSON objects in lower case, from up to n records in the order of appearance.
+func SampleJSONKeys(r io.Reader, n int) ([]JSONKey, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var keys []JSONKey
+	index := make(map[string]int)
+	for i := 0; i < n; i++ {
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read JSON, %w", err)
+		}
+		// keys in a record are sorted to keep the result stable
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v := obj[name]
+			lname := strings.ToLower(name)
+			if j, ok := index[lname]; ok {
+				if keys[j].Kind == "" && v != nil {
+					keys[j].Kind = jsonKind(v)
+				}
+				continue
+			}
+			var kind string
+			if v != nil {
+				kind = jsonKind(v)
+			}
+			index[lname] = len(keys)
+			keys = append(keys, JSONKey{Name: lname, Kind: kind})
+		}
+	}
+	for i := range keys {
+		if keys[i].Kind == "" {
+			keys[i].Kind = "string"
+		}
+	}
+	return keys, nil
+}
+
+// columnCache holds columns of tables and the time when an object was sampled last, by the identity of the connection and the table name.
+type columnCache struct {
+	mu      sync.Mutex
+	columns map[string]map[string]bool
+	sampled map[string]time.Time
+}
+
+func (c *columnCache) get(key string) map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.columns[key]
+}
+
+func (c *columnCache) set(key string, cols map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.columns == nil {
+		c.columns = make(map[string]map[string]bool)
+		c.sampled = make(map[string]time.Time)
+	}
+	c.columns[key] = cols
+	if cols == nil {
+		delete(c.sampled, key)
+	}
+}
+
+// recentlySampled reports whether the columns are cached and an object of the table was sampled in the interval.
+func (c *columnCache) recentlySampled(key string, interval time.Duration, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.sampled[key]
+	return ok && c.columns[key] != nil && now.Sub(t) < interval
+}
+
+func (c *columnCache) setSampled(key string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sampled != nil && c.columns[key] != nil {
+		c.sampled[key] = now
+	}
+}
+
+// checkSchemaDrift compares keys sampled from the object with columns of the table.
+// New keys are logged and notified, or added as columns by ALTER TABLE ADD COLUMN in alter mode.
+// Objects are not read while the table was sampled in the interval.
+func (r *Rin) checkSchemaDrift(ctx context.Context, req *ImportRequest, table string) error {
+	target := req.Target
+	d := target.SchemaDrift
+	cacheKey := target.Redshift.VisibleDSN() + "/" + table
+	now := time.Now()
+	if r.columns.recentlySampled(cacheKey, d.interval, now) {
+		return nil
+	}
+	body, err := r.openObject(ctx, req, d.Compression)
+	if err != nil {
+		return err
+	}
+	keys, err := SampleJSONKeys(body, d.Sample)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to sample keys from %s, %w", req.Record, err)
+	}
+
+	cols := r.columns.get(cacheKey)
+	missing := missingColumns(keys, cols)
+	if cols == nil || len(missing) > 0 {
+		// columns may have been added by others since cached
+		schema, name, err := target.ExpandTable(req.Record, req.Capture)
+		if err != nil {
+			return err
+		}
+		if cols, err = r.tableColumns(ctx, target, schema, name); err != nil {
+			return err
+		}
+		r.columns.set(cacheKey, cols)
+		missing = missingColumns(keys, cols)
+	}
+	r.columns.setSampled(cacheKey, now)
+	if len(missing) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(missing))
+	for _, k := range missing {
+		names = append(names, k.Name)
+	}
+	if d.Mode == SchemaDriftWarn {
+		msg := fmt.Sprintf("keys %s are not columns of %s", strings.Join(names, ", "), table)
+		r.logger.Printf("[warn] [%s] Schema drift: %s", req.MessageID, msg)
+		r.notify(&Notification{Event: NotifyDrift, MessageID: req.MessageID, Target: target.String(), Table: target.qualifiedTable(req.Record, req.Capture), Record: req.Record.String(), Error: msg})
+		return nil
+	}
+
+	stmts := make([]string, 0, len(missing))
+	for _, k := range missing {
+		stmts = append(stmts, fmt.Sprintf(AddColumnSQLTemplate, table, pq.QuoteIdentifier(k.Name), d.columnType(k.Kind)))
+	}
+	r.logger.Printf("[info] [%s] Schema drift: add columns %s to %s", req.MessageID, strings.Join(names, ", "), table)
+	if _, err := r.execRedshift(ctx, target, "", stmts, -1); err != nil {
+		// the columns may have been added by another worker
+		r.columns.set(cacheKey, nil)
+		return fmt.Errorf("failed to add columns to %s, %w", table, err)
+	}
+	added := make(map[string]bool, len(cols)+len(missing))
+	for c := range cols {
+		added[c] = true
+	}
+	for _, k := range missing {
+		added[k.Name] = true
+	}
+	r.columns.set(cacheKey, added)
+	r.columns.setSampled(cacheKey, now)
+	r.notify(&Notification{Event: NotifyDrift, MessageID: req.MessageID, Target: target.String(), Table: target.qualifiedTable(req.Record, req.Capture), Record: req.Record.String(), Error: fmt.Sprintf("columns %s were added to %s", strings.Join(names, ", "), table)})
+	return nil
+}
+
+func missingColumns(keys []JSONKey, cols map[string]bool) []JSONKey {
+	var missing []JSONKey
+	for _, k := range keys {
+		if !cols[k.Name] {
+			missing = append(missing, k)
+		}
+	}
+	return missing
+}
+
+// tableColumns returns columns of the table from svv_columns. An empty schema means public.
+func (r *Rin) tableColumns(ctx context.Context, target *Target, schema, table string) (map[string]bool, error) {
+	if schema == "" {
+		schema = "public"
+	}
+	query := fmt.Sprintf(ColumnsSQLTemplate, quoteLiteral(strings.ToLower(schema)), quoteLiteral(strings.ToLower(table)))
+	names, err := r.queryRedshift(ctx, target, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns of %s.%s, %w", schema, table, err)
+	}
+	if len(names) == 0 {
+		return nil, &TableNotFoundError{Table: schema + "." + table}
+	}
+	cols := make(map[string]bool, len(names))
+	for _, name := range names {
+		cols[name] = true
+	}
+	return cols, nil
+}
+
+// TableNotFoundError is returned when a table has no columns in svv_columns.
+type TableNotFoundError struct {
+	Table string
+}
+
+func (e *TableNotFoundError) Error() string {
+	return fmt.Sprintf("table %s does not exist", e.Table)
+}
+
+// queryRedshift executes the query and returns values of the first column as strings.
+func (r *Rin) queryRedshift(ctx context.Context, target *Target, query string) ([]string, error) {
+	if target.Redshift.Driver == DriverRedshiftData {
+		return r.queryDataAPI(ctx, target, query)
+	}
+	db, err := r.connectToRedshift(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Println("[debug] SQL:", query)
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,76 @@
+package rin_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+const driftTestObject = `{"id": 1, "name": "a"}
+{"id": 2, "Extra": "x", "score": 1.5, "flag": null}
+{"flag": true}
+`
+
+func TestSchemaDrift(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFinished, rows: 1, results: []string{"id", "name"}}
+	r, rec := newS3TestInstance(t, "test/config.schema_drift.yml", &memoryImporter{}, rin.WithRedshiftDataClient(f))
+	rec.objects = map[string]string{
+		"/test.bucket.test/warn/1.json":  driftTestObject,
+		"/test.bucket.test/alter/1.json": driftTestObject,
+		"/test.bucket.test/alter/2.json": driftTestObject,
+	}
+	event, _ := rin.ParseEvent([]byte(`{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"warn/1.json","size":10}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"alter/1.json","size":10}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"alter/2.json","size":10}}}
+	]}`))
+	if _, err := r.Import(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	var executed []string
+	for _, stmts := range f.executed {
+		executed = append(executed, strings.Join(stmts, "; "))
+	}
+	expected := []string{
+		// warn: only logged
+		`/* Rin */ SELECT column_name FROM svv_columns WHERE table_schema = 'public' AND table_name = 'foo'`,
+		`/* Rin */ COPY "foo"`,
+		// alter: columns are added before COPY
+		`/* Rin */ SELECT column_name FROM svv_columns WHERE table_schema = 'app' AND table_name = 'bar'`,
+		`/* Rin */ ALTER TABLE "app"."bar" ADD COLUMN "extra" VARCHAR(256); /* Rin */ ALTER TABLE "app"."bar" ADD COLUMN "flag" BOOLEAN; /* Rin */ ALTER TABLE "app"."bar" ADD COLUMN "score" DOUBLE PRECISION`,
+		`/* Rin */ COPY "app"."bar"`,
+		// the added columns are cached
+		`/* Rin */ COPY "app"."bar"`,
+	}
+	if len(executed) != len(expected) {
+		t.Fatalf("unexpected executed %v", executed)
+	}
+	for i, e := range expected {
+		if !strings.HasPrefix(executed[i], e) {
+			t.Errorf("unexpected statement %d %s", i, executed[i])
+		}
+	}
+	// alter/2.json is not read, because the table was sampled in the interval
+	if expected := "GET /test.bucket.test/warn/1.json,GET /test.bucket.test/alter/1.json"; strings.Join(rec.requests, ",") != expected {
+		t.Errorf("unexpected requests %v expected %s", rec.requests, expected)
+	}
+}
+
+func TestSampleJSONKeys(t *testing.T) {
+	keys, err := rin.SampleJSONKeys(strings.NewReader(driftTestObject), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []string
+	for _, k := range keys {
+		s = append(s, k.Name+":"+k.Kind)
+	}
+	// flag is null in the sampled records
+	if strings.Join(s, ",") != "id:integer,name:string,extra:string,flag:string,score:number" {
+		t.Errorf("unexpected keys %v", s)
+	}
+}
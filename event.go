@@ -70,6 +70,18 @@ type EventRecord struct {
 	EventTime    string  `json:"eventTime"`
 	AWSRegion    string  `json:"awsRegion"`
 	S3           S3Event `json:"s3"`
+
+	// Attributes are fetched from S3 when a target requires them.
+	Attributes *ObjectAttributes `json:"-"`
+}
+
+func (r EventRecord) IsObjectRemoved() bool {
+	return strings.HasPrefix(trimEventNamePrefix(r.EventName), "ObjectRemoved:")
+}
+
+// trimEventNamePrefix trims "s3:" prefix which is used in the bucket notification configuration.
+func trimEventNamePrefix(name string) string {
+	return strings.TrimPrefix(name, "s3:")
 }
 
 func (r EventRecord) String() string {
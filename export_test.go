@@ -0,0 +1,17 @@
+package rin
+
+import (
+	"context"
+	"time"
+)
+
+// LambdaSQSEventHandler is the handler of Lambda in the SQS event mode.
+var LambdaSQSEventHandler = (*Rin).lambdaSQSEventHandler
+
+// PostgresConnString returns the connection string of postgres-stream targets.
+var PostgresConnString = postgresConnString
+
+// SetThrottleClock replaces the clock and the sleep to wait for rate limits of the instance.
+func SetThrottleClock(r *Rin, now func() time.Time, sleep func(ctx context.Context, d time.Duration) error) {
+	r.throttle.now, r.throttle.sleep = now, sleep
+}
@@ -0,0 +1,139 @@
+package rin_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func newFIFOHarness(t *testing.T, imp *keyImporter, opts ...rin.InstanceOption) *harness {
+	return newHarness(t, "test/config.fifo.yml", append([]rin.InstanceOption{
+		withMemoryImporter(imp),
+	}, opts...)...)
+}
+
+func TestFIFOGroups(t *testing.T) {
+	bStarted := make(chan struct{})
+	var once sync.Once
+	imp := &keyImporter{hook: func(key string) error {
+		switch key {
+		case "fifo/b1.json":
+			once.Do(func() { close(bStarted) })
+		case "fifo/a1.json":
+			// groups are processed in parallel, so b1 starts while a1 is in process
+			select {
+			case <-bStarted:
+			case <-time.After(5 * time.Second):
+				return errors.New("groups were not processed in parallel")
+			}
+		}
+		return nil
+	}}
+	h := newFIFOHarness(t, imp)
+	for _, m := range [][2]string{{"a", "a1"}, {"b", "b1"}, {"a", "a2"}, {"b", "b2"}, {"a", "a3"}} {
+		h.sqs.SendToGroup("rin_ordered.fifo", m[0], s3Event("fifo/"+m[1]+".json"))
+	}
+	h.run(t)
+
+	if keys := imp.keys("fifo/a"); keys != "fifo/a1.json fifo/a2.json fifo/a3.json" {
+		t.Errorf("unexpected order of group a: %s", keys)
+	}
+	if keys := imp.keys("fifo/b"); keys != "fifo/b1.json fifo/b2.json" {
+		t.Errorf("unexpected order of group b: %s", keys)
+	}
+	if d := h.sqs.Deleted("rin_ordered.fifo"); len(d) != 5 {
+		t.Errorf("unexpected deleted messages %v", d)
+	}
+}
+
+func TestFIFOAbort(t *testing.T) {
+	var failed bool
+	imp := &keyImporter{hook: func(key string) error {
+		if key == "fifo/a1.json" && !failed {
+			failed = true
+			return errors.New("failed")
+		}
+		return nil
+	}}
+	h := newFIFOHarness(t, imp)
+	h.sqs.VisibilityTimeout = 200 * time.Millisecond
+	a1 := h.sqs.SendToGroup("rin_ordered.fifo", "a", s3Event("fifo/a1.json"))
+	a2 := h.sqs.SendToGroup("rin_ordered.fifo", "a", s3Event("fifo/a2.json"))
+	b1 := h.sqs.SendToGroup("rin_ordered.fifo", "b", s3Event("fifo/b1.json"))
+	h.run(t)
+
+	// a2 is skipped after a1 was aborted, and b1 is not affected
+	if keys := imp.keys("fifo/"); keys != "fifo/b1.json" {
+		t.Errorf("unexpected imports %s", keys)
+	}
+	if d := h.sqs.Deleted("rin_ordered.fifo"); len(d) != 1 || d[0] != b1 {
+		t.Errorf("unexpected deleted messages %v", d)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	h.run(t)
+	if keys := imp.keys("fifo/a"); keys != "fifo/a1.json fifo/a2.json" {
+		t.Errorf("group a must be processed in order after the visibility timeout: %s", keys)
+	}
+	if n := h.sqs.Receives(a1); n != 2 {
+		t.Errorf("a1 must be received again. received %d times", n)
+	}
+	if n := h.sqs.Receives(a2); n != 2 {
+		t.Errorf("a2 must be received again. received %d times", n)
+	}
+}
+
+func TestFIFOInFlight(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	imp := &keyImporter{hook: func(key string) error {
+		started <- key
+		if key == "fifo/a1.json" {
+			<-release
+		}
+		return nil
+	}}
+	h := newFIFOHarness(t, imp, rin.WithOption(&rin.Option{}))
+	// messages in flight must not be delivered again
+	h.sqs.VisibilityTimeout = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- h.rin.Run(ctx)
+	}()
+	h.sqs.SendToGroup("rin_inflight.fifo", "a", s3Event("fifo/a1.json"))
+	if key := <-started; key != "fifo/a1.json" {
+		t.Fatalf("unexpected import %s", key)
+	}
+	// a2 is blocked by a1 in flight, but b1 in another group is processed
+	a2 := h.sqs.SendToGroup("rin_inflight.fifo", "a", s3Event("fifo/a2.json"))
+	h.sqs.SendToGroup("rin_inflight.fifo", "b", s3Event("fifo/b1.json"))
+	if key := <-started; key != "fifo/b1.json" {
+		t.Fatalf("unexpected import %s", key)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := h.sqs.Receives(a2); n != 0 {
+		t.Errorf("a2 must not be received while a1 is in flight. received %d times", n)
+	}
+
+	close(release)
+	if key := <-started; key != "fifo/a2.json" {
+		t.Fatalf("unexpected import %s", key)
+	}
+	h.rin.Drain()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if keys := imp.keys("fifo/a"); keys != "fifo/a1.json fifo/a2.json" {
+		t.Errorf("unexpected order of group a: %s", keys)
+	}
+	if d := h.sqs.Deleted("rin_inflight.fifo"); len(d) != 3 {
+		t.Errorf("unexpected deleted messages %v", d)
+	}
+}
@@ -9,12 +9,18 @@ require (
 	github.com/aws/aws-sdk-go-v2/credentials v1.13.0
 	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.11.30
 	github.com/aws/aws-sdk-go-v2/service/redshift v1.26.7
+	github.com/aws/aws-sdk-go-v2/service/redshiftdata v1.16.13
+	github.com/aws/aws-sdk-go-v2/service/redshiftserverless v1.2.2
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.27.8
+	github.com/aws/aws-sdk-go-v2/service/sns v1.18.6
 	github.com/aws/aws-sdk-go-v2/service/sqs v1.19.7
 	github.com/hashicorp/logutils v1.0.0
+	github.com/jackc/pgconn v1.14.3
 	github.com/kayac/go-config v0.6.0
+	github.com/klauspost/compress v1.15.12
 	github.com/lib/pq v1.10.6
 	github.com/mashiike/redshift-data-sql-driver v0.1.0
+	golang.org/x/time v0.3.0
 )
 
 require (
@@ -29,12 +35,18 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/internal/checksum v1.1.15 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/presigned-url v1.9.19 // indirect
 	github.com/aws/aws-sdk-go-v2/service/internal/s3shared v1.13.14 // indirect
-	github.com/aws/aws-sdk-go-v2/service/redshiftdata v1.16.13 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sso v1.11.25 // indirect
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.13.8 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.17.2 // indirect
 	github.com/aws/smithy-go v1.13.4 // indirect
+	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
+	github.com/jackc/pgio v1.0.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgproto3/v2 v2.3.3 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/crypto v0.20.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
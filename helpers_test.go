@@ -0,0 +1,401 @@
+package rin_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	rin "github.com/fujiwara/Rin"
+	"github.com/fujiwara/Rin/rintest"
+)
+
+// testSessions returns AWS configurations with static credentials, which don't load credentials from the environment.
+func testSessions() *rin.SessionStore {
+	awsCfg := &aws.Config{
+		Region:      "ap-northeast-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	return &rin.SessionStore{SQS: awsCfg, Redshift: awsCfg, S3: awsCfg}
+}
+
+func loadTestConfig(t *testing.T, path string) *rin.Config {
+	t.Helper()
+	config, err := rin.LoadConfig(context.Background(), path)
+	if err != nil {
+		t.Fatalf("load config failed: %s", err)
+	}
+	return config
+}
+
+// newTestInstance creates an instance for the configuration file by testSessions and a discarding logger, and closes it at the end of the test.
+// opts are applied after them, so they can be overridden.
+func newTestInstance(t *testing.T, path string, opts ...rin.InstanceOption) *rin.Rin {
+	t.Helper()
+	return newTestInstanceWithConfig(t, loadTestConfig(t, path), opts...)
+}
+
+func newTestInstanceWithConfig(t *testing.T, config *rin.Config, opts ...rin.InstanceOption) *rin.Rin {
+	t.Helper()
+	r, err := rin.New(config, append([]rin.InstanceOption{
+		rin.WithSessions(testSessions()),
+		rin.WithLogger(log.New(io.Discard, "", 0)),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// withMemoryImporter imports records by imp for targets of the "memory" type.
+func withMemoryImporter(imp rin.Importer) rin.InstanceOption {
+	return rin.WithImporter("memory", func(_ *rin.Rin, _ *rin.Target) (rin.Importer, error) {
+		return imp, nil
+	})
+}
+
+// newS3TestInstance creates an instance which sends S3 requests to a recorder, and imports by imp as "memory" type.
+func newS3TestInstance(t *testing.T, path string, imp rin.Importer, opts ...rin.InstanceOption) (*rin.Rin, *s3Recorder) {
+	t.Helper()
+	rec := &s3Recorder{}
+	ts := httptest.NewServer(rec)
+	t.Cleanup(ts.Close)
+	sessions := testSessions()
+	sessions.S3OptFns = []func(*s3.Options){func(o *s3.Options) {
+		o.EndpointResolver = s3.EndpointResolverFromURL(ts.URL)
+		o.UsePathStyle = true
+	}}
+	r := newTestInstance(t, path, append([]rin.InstanceOption{
+		rin.WithSessions(sessions),
+		withMemoryImporter(imp),
+	}, opts...)...)
+	return r, rec
+}
+
+type harness struct {
+	rin *rin.Rin
+	sqs *rintest.SQS
+	s3  *rintest.S3
+	db  *rintest.DB
+}
+
+// newHarness creates an instance which works with in-memory SQS, S3 and Redshift.
+func newHarness(t *testing.T, path string, opts ...rin.InstanceOption) *harness {
+	t.Helper()
+	h := &harness{sqs: rintest.NewSQS(), s3: rintest.NewS3(), db: rintest.NewDB()}
+	t.Cleanup(h.sqs.Close)
+	t.Cleanup(h.s3.Close)
+
+	config := loadTestConfig(t, path)
+	for _, q := range config.Queues {
+		h.sqs.CreateQueue(q.Name)
+	}
+	h.rin = newTestInstanceWithConfig(t, config, append([]rin.InstanceOption{
+		rin.WithSessions(rintest.Sessions(h.sqs, h.s3)),
+		rin.WithConnector(h.db),
+		rin.WithOption(&rin.Option{BatchMode: true}),
+	}, opts...)...)
+	return h
+}
+
+// run runs workers until all queues are empty.
+func (h *harness) run(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := h.rin.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (h *harness) copies() []string {
+	var copies []string
+	for _, s := range h.db.Statements() {
+		if strings.HasPrefix(s, "/* Rin */ COPY") {
+			copies = append(copies, s)
+		}
+	}
+	return copies
+}
+
+func s3Event(key string) string {
+	return fmt.Sprintf(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":%q,"size":10}}}]}`, key)
+}
+
+func importKeys(t *testing.T, r *rin.Rin, keys []string) {
+	t.Helper()
+	sendEvents(t, r, "ObjectCreated:Put", keys)
+}
+
+func sendEvents(t *testing.T, r *rin.Rin, eventName string, keys []string) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			event, _ := rin.ParseEvent([]byte(fmt.Sprintf(
+				`{"Records":[{"eventName":%q,"s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":%q,"size":10}}}]}`, eventName, key,
+			)))
+			if _, err := r.Import(context.Background(), event); err != nil {
+				t.Errorf("import %s failed: %s", key, err)
+			}
+		}(i, key)
+	}
+	wg.Wait()
+}
+
+func count(ss []string, s string) int {
+	var n int
+	for _, v := range ss {
+		if v == s {
+			n++
+		}
+	}
+	return n
+}
+
+// failingImporter fails imports by err, or succeeds when err is nil.
+type failingImporter struct {
+	err error
+}
+
+func (i *failingImporter) Import(ctx context.Context, req *rin.ImportRequest) error {
+	return i.err
+}
+
+// reportingImporter reports rows and SQL as an importer which loads the objects.
+type reportingImporter struct {
+	err error
+}
+
+func (i *reportingImporter) Import(ctx context.Context, req *rin.ImportRequest) error {
+	if i.err != nil {
+		return i.err
+	}
+	req.Report(42, "COPY "+req.Record.S3.Object.Key)
+	return nil
+}
+
+type memoryImporter struct {
+	imported []string
+	removed  []string
+}
+
+func (m *memoryImporter) Import(ctx context.Context, req *rin.ImportRequest) error {
+	schema, table, err := req.Target.ExpandTable(req.Record, req.Capture)
+	if err != nil {
+		return err
+	}
+	m.imported = append(m.imported, schema+"."+table+" "+req.Record.S3.Object.Key)
+	return nil
+}
+
+func (m *memoryImporter) Remove(ctx context.Context, req *rin.ImportRequest) error {
+	m.removed = append(m.removed, req.Record.S3.Object.Key)
+	return nil
+}
+
+// keyImporter records imported keys in order. hook is called before recording, and its error fails the import.
+type keyImporter struct {
+	mu       sync.Mutex
+	imported []string
+	hook     func(key string) error
+}
+
+func (i *keyImporter) Import(ctx context.Context, req *rin.ImportRequest) error {
+	key := req.Record.S3.Object.Key
+	if i.hook != nil {
+		if err := i.hook(key); err != nil {
+			return err
+		}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.imported = append(i.imported, key)
+	return nil
+}
+
+// keys returns the imported keys which have the prefix.
+func (i *keyImporter) keys(prefix string) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var keys []string
+	for _, k := range i.imported {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return strings.Join(keys, " ")
+}
+
+// blockingImporter blocks imports until released.
+type blockingImporter struct {
+	started chan string
+	release chan struct{}
+}
+
+func (i *blockingImporter) Import(ctx context.Context, req *rin.ImportRequest) error {
+	i.started <- req.MessageID
+	<-i.release
+	return nil
+}
+
+// s3Recorder is a fake S3 endpoint which records requests.
+type s3Recorder struct {
+	mu       sync.Mutex
+	requests []string
+	bodies   []string
+	objects  map[string]string // bodies of objects by path
+}
+
+func (s *s3Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req := r.Method + " " + r.URL.Path
+	if _, ok := r.URL.Query()["tagging"]; ok {
+		req += "?tagging"
+	}
+	if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+		req += " from " + src
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.requests = append(s.requests, req)
+	s.bodies = append(s.bodies, string(body))
+	switch {
+	case r.Method == http.MethodGet && s.objects[r.URL.Path] != "":
+		io.WriteString(w, s.objects[r.URL.Path])
+	case r.Method == http.MethodGet:
+		io.WriteString(w, `<Tagging><TagSet><Tag><Key>owner</Key><Value>app</Value></Tag></TagSet></Tagging>`)
+	case r.Header.Get("X-Amz-Copy-Source") != "":
+		io.WriteString(w, `<CopyObjectResult><ETag>"x"</ETag></CopyObjectResult>`)
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// notificationRecorder is a fake endpoint of webhooks and Slack which records notifications.
+type notificationRecorder struct {
+	mu      sync.Mutex
+	webhook []*rin.Notification
+	slack   []string
+}
+
+func (n *notificationRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b, _ := io.ReadAll(r.Body)
+	switch r.URL.Path {
+	case "/webhook":
+		var m rin.Notification
+		json.Unmarshal(b, &m)
+		n.webhook = append(n.webhook, &m)
+	case "/slack":
+		var m struct {
+			Text string `json:"text"`
+		}
+		json.Unmarshal(b, &m)
+		n.slack = append(n.slack, m.Text)
+	}
+}
+
+// fakeRedshiftData completes a statement after polls DescribeStatement calls.
+type fakeRedshiftData struct {
+	mu       sync.Mutex
+	polls    int
+	status   types.StatusString
+	executed [][]string
+	describe map[string]int
+	batches  map[string][]string
+	rows     int64
+	results  []string // values of GetStatementResult
+	execErr  error
+
+	describeErrors int // the next DescribeStatement calls fail
+
+	running    int
+	maxRunning int
+}
+
+func (f *fakeRedshiftData) start() {
+	f.running++
+	if f.running > f.maxRunning {
+		f.maxRunning = f.running
+	}
+}
+
+func (f *fakeRedshiftData) ExecuteStatement(ctx context.Context, in *redshiftdata.ExecuteStatementInput, _ ...func(*redshiftdata.Options)) (*redshiftdata.ExecuteStatementOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.execErr != nil {
+		return nil, f.execErr
+	}
+	f.executed = append(f.executed, []string{*in.Sql})
+	f.start()
+	return &redshiftdata.ExecuteStatementOutput{Id: aws.String(fmt.Sprintf("stmt-%d", len(f.executed)))}, nil
+}
+
+func (f *fakeRedshiftData) BatchExecuteStatement(ctx context.Context, in *redshiftdata.BatchExecuteStatementInput, _ ...func(*redshiftdata.Options)) (*redshiftdata.BatchExecuteStatementOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.executed = append(f.executed, in.Sqls)
+	f.start()
+	id := fmt.Sprintf("stmt-%d", len(f.executed))
+	if f.batches == nil {
+		f.batches = make(map[string][]string)
+	}
+	f.batches[id] = in.Sqls
+	return &redshiftdata.BatchExecuteStatementOutput{Id: aws.String(id)}, nil
+}
+
+func (f *fakeRedshiftData) DescribeStatement(ctx context.Context, in *redshiftdata.DescribeStatementInput, _ ...func(*redshiftdata.Options)) (*redshiftdata.DescribeStatementOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.describeErrors > 0 {
+		f.describeErrors--
+		return nil, &types.InternalServerException{Message: aws.String("throttled")}
+	}
+	if f.describe == nil {
+		f.describe = make(map[string]int)
+	}
+	f.describe[*in.Id]++
+	status := types.StatusStringStarted
+	if f.describe[*in.Id] > f.polls {
+		status = f.status
+		f.running--
+	}
+	res := &redshiftdata.DescribeStatementOutput{Id: in.Id, Status: status, Error: aws.String("error by fake"), ResultRows: f.rows}
+	for i, q := range f.batches[*in.Id] {
+		sub := types.SubStatementData{ResultRows: f.rows * int64(i+1), Status: types.StatementStatusStringFinished}
+		if status == types.StatusStringFinished && q == rin.NonEmptyCheckSQL && f.rows == 0 {
+			// the batch fails by division by zero
+			sub.Status, res.Status = types.StatementStatusStringFailed, types.StatusStringFailed
+		}
+		res.SubStatements = append(res.SubStatements, sub)
+	}
+	return res, nil
+}
+
+func (f *fakeRedshiftData) GetStatementResult(ctx context.Context, in *redshiftdata.GetStatementResultInput, _ ...func(*redshiftdata.Options)) (*redshiftdata.GetStatementResultOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := &redshiftdata.GetStatementResultOutput{}
+	for _, v := range f.results {
+		res.Records = append(res.Records, []types.Field{&types.FieldMemberStringValue{Value: v}})
+	}
+	return res, nil
+}
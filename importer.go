@@ -0,0 +1,119 @@
+package rin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Importer imports S3 objects into a destination.
+type Importer interface {
+	Import(ctx context.Context, req *ImportRequest) error
+}
+
+// Remover is implemented by importers which handle ObjectRemoved events for targets with on_remove.
+type Remover interface {
+	Remove(ctx context.Context, req *ImportRequest) error
+}
+
+// ImportRequest represents a record matched to a target.
+type ImportRequest struct {
+	Target  *Target
+	Record  *EventRecord
+	Capture *[]string
+
+	// MessageID is the ID of the SQS message which contains the record. It is empty for Import.
+	MessageID string
+
+	// Result is the result of the record reported by the importer. It may be nil.
+	Result *ImportResult
+}
+
+// ImporterFactory creates an Importer for the target of the instance.
+type ImporterFactory func(r *Rin, target *Target) (Importer, error)
+
+var (
+	importerFactories = map[string]ImporterFactory{
+		TypeRedshift: newRedshiftImporter,
+	}
+	importerFactoriesMutex sync.RWMutex
+)
+
+// RegisterImporter makes an importer available by the name for target.type.
+// If RegisterImporter is called twice with the same name or if factory is nil, it panics.
+func RegisterImporter(name string, factory ImporterFactory) {
+	importerFactoriesMutex.Lock()
+	defer importerFactoriesMutex.Unlock()
+	if factory == nil {
+		panic("rin: RegisterImporter factory is nil")
+	}
+	if _, dup := importerFactories[name]; dup {
+		panic("rin: RegisterImporter called twice for importer " + name)
+	}
+	importerFactories[name] = factory
+}
+
+// Importers returns a sorted list of the names of the registered importers.
+func Importers() []string {
+	importerFactoriesMutex.RLock()
+	defer importerFactoriesMutex.RUnlock()
+	names := make([]string, 0, len(importerFactories))
+	for name := range importerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithImporter registers an importer only for the instance.
+func WithImporter(name string, factory ImporterFactory) InstanceOption {
+	return func(r *Rin) {
+		if r.importerFactories == nil {
+			r.importerFactories = make(map[string]ImporterFactory)
+		}
+		r.importerFactories[name] = factory
+	}
+}
+
+func (r *Rin) importerFactory(name string) (ImporterFactory, bool) {
+	if f, ok := r.importerFactories[name]; ok {
+		return f, true
+	}
+	importerFactoriesMutex.RLock()
+	defer importerFactoriesMutex.RUnlock()
+	f, ok := importerFactories[name]
+	return f, ok
+}
+
+func (r *Rin) setupImporters() error {
+	r.importers = make(map[*Target]Importer)
+	for _, t := range r.allTargets() {
+		if t.Discard {
+			continue
+		}
+		if _, ok := r.importers[t]; ok {
+			continue
+		}
+		factory, ok := r.importerFactory(t.Type)
+		if !ok {
+			return fmt.Errorf("unknown target.type %s", t.Type)
+		}
+		imp, err := factory(r, t)
+		if err != nil {
+			return fmt.Errorf("failed to create %s importer for %s: %w", t.Type, t, err)
+		}
+		if t.OnRemove != nil {
+			if _, ok := imp.(Remover); !ok {
+				return fmt.Errorf("target.type %s does not support on_remove", t.Type)
+			}
+		}
+		r.importers[t] = imp
+	}
+	return nil
+}
+
+// Importer returns the importer for the target of the instance.
+func (r *Rin) Importer(target *Target) Importer {
+	return r.importers[target]
+}
@@ -0,0 +1,60 @@
+package rin_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestCustomImporter(t *testing.T) {
+	ctx := context.Background()
+	config := loadTestConfig(t, "test/config.importer.yml")
+	if _, err := rin.New(config); err == nil {
+		t.Error("New must be failed for unknown target.type")
+	}
+
+	m := &memoryImporter{}
+	r := newTestInstanceWithConfig(t, config, withMemoryImporter(m))
+
+	event, err := rin.ParseEvent([]byte(`{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"memory/foo/bar/1.json","size":10}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"other/2.json","size":10}}},
+		{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"memory/foo/bar/3.json"}}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := r.Import(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := results.Processed(); n != 3 {
+		t.Errorf("unexpected processed count %d", n)
+	}
+	var outcomes []string
+	for _, res := range results {
+		outcomes = append(outcomes, res.Key+":"+res.Outcome)
+	}
+	if s := strings.Join(outcomes, ","); s != "memory/foo/bar/1.json:imported,other/2.json:imported,memory/foo/bar/3.json:removed" {
+		t.Errorf("unexpected outcomes %s", s)
+	}
+	if s := strings.Join(m.imported, ","); s != "foo.bar memory/foo/bar/1.json,.other other/2.json" {
+		t.Errorf("unexpected imported %s", s)
+	}
+	if s := strings.Join(m.removed, ","); s != "memory/foo/bar/3.json" {
+		t.Errorf("unexpected removed %s", s)
+	}
+}
+
+func TestRegisterImporterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterImporter must panic for a registered name")
+		}
+	}()
+	rin.RegisterImporter(rin.TypeRedshift, func(_ *rin.Rin, _ *rin.Target) (rin.Importer, error) {
+		return nil, nil
+	})
+}
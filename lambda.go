@@ -3,8 +3,9 @@ package rin
 import (
 	"context"
 	"errors"
-	"log"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -18,42 +19,102 @@ type BatchItemFailureItem struct {
 	ItemIdentifier string `json:"itemIdentifier"`
 }
 
-func runLambdaHandler(opt *Option) error {
-	if opt.BatchMode {
-		log.Printf("[info] starting lambda handler SQS batch mode")
-		lambda.Start(newLambdaSQSBatchHandler(opt))
+func (r *Rin) runLambdaHandler() error {
+	if r.option.BatchMode {
+		r.logger.Printf("[info] starting lambda handler SQS batch mode")
+		lambda.Start(r.newLambdaSQSBatchHandler())
 	} else {
-		log.Printf("[info] starting lambda handler SQS event mode")
-		lambda.Start(lambdaSQSEventHandler)
+		r.logger.Printf("[info] starting lambda handler SQS event mode")
+		lambda.Start(r.lambdaSQSEventHandler)
 	}
 	return nil
 }
 
-func lambdaSQSEventHandler(ctx context.Context, event *events.SQSEvent) (*SQSBatchResponse, error) {
+func (r *Rin) lambdaSQSEventHandler(ctx context.Context, event *events.SQSEvent) (*SQSBatchResponse, error) {
+	// the execution environment may be frozen after the handler returns
+	defer r.waitNotifications()
 	resp := &SQSBatchResponse{
 		BatchItemFailures: nil,
 	}
+	// message groups which have a failed message in FIFO queues
+	failedGroups := make(map[string]bool)
+	// queues to defer messages, by the event source ARN
+	queues := make(map[string]*sqsQueue)
 	for _, record := range event.Records {
 		if record.MessageId == "" {
 			return nil, errors.New("sqs message id is empty")
 		}
-		if err := processEvent(ctx, record.MessageId, record.Body); err != nil {
+		group := record.Attributes["MessageGroupId"]
+		if group != "" && failedGroups[group] {
+			// keep the order in the group. retry with the failed message
+			r.logger.Printf("[warn] [%s] Skipped because a previous message in group %s failed", record.MessageId, group)
 			resp.BatchItemFailures = append(resp.BatchItemFailures, BatchItemFailureItem{
 				ItemIdentifier: record.MessageId,
 			})
+			continue
+		}
+		targets, final := r.config.Targets, false
+		q := r.queueForEventSource(record.EventSourceARN)
+		if q != nil {
+			count, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+			targets, final = q.targets, q.isFinalAttempt(count)
+		}
+		if err := r.processEvent(ctx, targets, record.MessageId, record.Body, final); err != nil {
+			if e, ok := err.(*DeferredError); ok && r.deferRecord(ctx, queues, q, record, e.Until) {
+				continue
+			}
+			resp.BatchItemFailures = append(resp.BatchItemFailures, BatchItemFailureItem{
+				ItemIdentifier: record.MessageId,
+			})
+			if group != "" {
+				failedGroups[group] = true
+			}
 		}
 	}
 	return resp, nil
 }
 
-func newLambdaSQSBatchHandler(opt *Option) func(ctx context.Context) error {
+// queueForEventSource returns the queue which the SQS message came from, or nil if it is not configured.
+func (r *Rin) queueForEventSource(arn string) *Queue {
+	return r.config.QueueByName(arn[strings.LastIndex(arn, ":")+1:])
+}
+
+// deferRecord delivers the record again at until by defer of the queue. It returns false when the record must be reported as failed to keep it in the queue.
+// Records deferred by the visibility timeout must be reported, because Lambda deletes the records which are not reported.
+func (r *Rin) deferRecord(ctx context.Context, queues map[string]*sqsQueue, q *Queue, record events.SQSMessage, until time.Time) bool {
+	arn := record.EventSourceARN
+	sq, ok := queues[arn]
+	if !ok {
+		if q == nil {
+			q = &Queue{Name: arn[strings.LastIndex(arn, ":")+1:], Defer: DeferVisibility}
+		}
+		var err error
+		if sq, err = r.newSQSQueue(ctx, q); err != nil {
+			r.logger.Printf("[warn] [%s] Can't defer message. It will be delivered again after the visibility timeout. %s", record.MessageId, err)
+			return false
+		}
+		queues[arn] = sq
+	}
+	msg := &Message{
+		ID:            record.MessageId,
+		Body:          record.Body,
+		GroupID:       record.Attributes["MessageGroupId"],
+		ReceiptHandle: record.ReceiptHandle,
+	}
+	if err := sq.Defer(ctx, msg, time.Until(until)); err != nil {
+		r.logger.Printf("[warn] [%s] Can't defer message. It will be delivered again after the visibility timeout. %s", record.MessageId, err)
+		return false
+	}
+	r.logger.Printf("[info] [%s] Deferred message until %s.", record.MessageId, until.Format(time.RFC3339))
+	return sq.queue.Defer == DeferRequeue
+}
+
+func (r *Rin) newLambdaSQSBatchHandler() func(ctx context.Context) error {
 	return func(ctx context.Context) error {
-		var wg sync.WaitGroup
-		wg.Add(1)
-		err := sqsWorker(ctx, &wg, opt)
-		wg.Wait()
+		defer r.waitNotifications()
+		err := r.runWorkers(ctx)
 		if e, ok := err.(MaxExecutionTimeReachedError); ok {
-			log.Printf("[info] %s", e.Error())
+			r.logger.Printf("[info] %s", e.Error())
 			return nil
 		}
 		return err
@@ -0,0 +1,185 @@
+package rin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+func (t *Target) Match(bucket, key string) (bool, *[]string) {
+	if bucket != t.S3.Bucket {
+		return false, nil
+	}
+	return t.keyMatcher(key)
+}
+
+func (t *Target) MatchEventRecord(r *EventRecord) (bool, *[]string) {
+	if !t.MatchEventName(r.EventName) {
+		return false, nil
+	}
+	if r.IsObjectRemoved() {
+		if t.OnRemove == nil && !t.Discard {
+			// nothing to do for removed objects
+			return false, nil
+		}
+	} else if !t.MatchSize(r.S3.Object.Size) {
+		return false, nil
+	}
+	return t.Match(r.S3.Bucket.Name, r.S3.Object.Key)
+}
+
+func (t *Target) MatchEventName(name string) bool {
+	if t.eventMatcher == nil {
+		return true
+	}
+	return t.eventMatcher(name)
+}
+
+func (t *Target) MatchSize(size int64) bool {
+	s := t.S3
+	if size == 0 && !s.AllowEmpty {
+		// zero-byte objects (e.g. directory markers) can't be imported
+		return false
+	}
+	if s.MinSize > 0 && size < s.MinSize {
+		return false
+	}
+	if s.MaxSize > 0 && size > s.MaxSize {
+		return false
+	}
+	return true
+}
+
+func (t *Target) buildEventMatcher() error {
+	if len(t.EventNames) == 0 {
+		return nil
+	}
+	patterns := make([]string, 0, len(t.EventNames))
+	for _, name := range t.EventNames {
+		name = trimEventNamePrefix(name)
+		if name == "" {
+			return fmt.Errorf("target.event_names must not contain an empty name")
+		}
+		if i := strings.Index(name, "*"); i >= 0 && i != len(name)-1 {
+			return fmt.Errorf("target.event_names %s: wildcard is allowed only at the end", name)
+		}
+		patterns = append(patterns, name)
+	}
+	t.eventMatcher = func(name string) bool {
+		name = trimEventNamePrefix(name)
+		for _, p := range patterns {
+			if strings.HasSuffix(p, "*") {
+				if strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+					return true
+				}
+			} else if name == p {
+				return true
+			}
+		}
+		return false
+	}
+	return nil
+}
+
+func (t *Target) buildKeyMatcher() error {
+	s := t.S3
+	if !s.hasKeyMatcher() {
+		return fmt.Errorf("target.key_prefix, key_suffix, key_glob or key_regexp is not defined")
+	}
+	if s.KeyRegexp != "" && s.KeyGlob != "" {
+		return fmt.Errorf("target.key_regexp and key_glob are exclusive")
+	}
+	if s.MinSize < 0 || s.MaxSize < 0 {
+		return fmt.Errorf("target.min_size and max_size must not be negative")
+	}
+	if s.MaxSize > 0 && s.MinSize > s.MaxSize {
+		return fmt.Errorf("target.min_size %d is larger than max_size %d", s.MinSize, s.MaxSize)
+	}
+
+	// capture is built by key_regexp or key_glob. otherwise the whole key is $0.
+	var reg *regexp.Regexp
+	if r := s.KeyRegexp; r != "" {
+		var err error
+		if reg, err = regexp.Compile(r); err != nil {
+			return fmt.Errorf("target.key_regexp %s: %w", r, err)
+		}
+	} else if g := s.KeyGlob; g != "" {
+		var err error
+		if reg, err = compileGlob(g); err != nil {
+			return fmt.Errorf("target.key_glob %s: %w", g, err)
+		}
+	}
+	excludes := make([]*regexp.Regexp, 0, len(s.Exclude))
+	for _, g := range s.Exclude {
+		if g == "" {
+			return fmt.Errorf("target.exclude must not contain an empty pattern")
+		}
+		ex, err := compileGlob(g)
+		if err != nil {
+			return fmt.Errorf("target.exclude %s: %w", g, err)
+		}
+		excludes = append(excludes, ex)
+	}
+	prefix, suffix := s.KeyPrefix, s.KeySuffix
+
+	t.keyMatcher = func(key string) (bool, *[]string) {
+		if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) {
+			return false, nil
+		}
+		for _, ex := range excludes {
+			if ex.MatchString(key) {
+				return false, nil
+			}
+		}
+		if reg == nil {
+			capture := []string{key}
+			return true, &capture
+		}
+		capture := reg.FindStringSubmatch(key)
+		if len(capture) == 0 {
+			return false, nil
+		}
+		return true, &capture
+	}
+	return nil
+}
+
+// compileGlob compiles a glob pattern into an anchored regexp.
+// "*" and "?" match within a path segment, "**" matches across segments.
+// Each wildcard is captured, so the values can be referred as $1, $2...
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:(.*)/)?")
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString("(.*)")
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString("([^/]*)")
+			i++
+		case pattern[i] == '?':
+			b.WriteString("([^/])")
+			i++
+		case pattern[i] == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("([" + class + "])")
+			i += end + 2
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			i++
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,354 @@
+package rin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"golang.org/x/time/rate"
+)
+
+const (
+	NotifyFailure = "failure"
+	NotifyPoison  = "poison"
+	NotifySuccess = "success"
+	NotifyDrift   = "drift"
+
+	NotifierWebhook = "webhook"
+	NotifierSNS     = "sns"
+	NotifierSlack   = "slack"
+)
+
+var (
+	DefaultNotifyInterval = 10 * time.Minute
+	DefaultNotifyBurst    = 5
+	NotifyTimeout         = 10 * time.Second
+	NotifyQueueSize       = 100
+)
+
+// NotifierConfig represents a sink of notifications.
+type NotifierConfig struct {
+	Type     string   `yaml:"type"`
+	URL      string   `yaml:"url"`
+	TopicArn string   `yaml:"topic_arn"`
+	Events   []string `yaml:"events"`
+	Interval string   `yaml:"interval"`
+	Burst    int      `yaml:"burst"`
+
+	interval time.Duration
+}
+
+func (n *NotifierConfig) setup() error {
+	switch n.Type {
+	case NotifierWebhook, NotifierSlack:
+		if n.URL == "" {
+			return fmt.Errorf("notifiers.url is required for %s", n.Type)
+		}
+	case NotifierSNS:
+		if n.TopicArn == "" {
+			return fmt.Errorf("notifiers.topic_arn is required for %s", n.Type)
+		}
+	default:
+		return fmt.Errorf("notifiers.type must be %s, %s or %s", NotifierWebhook, NotifierSNS, NotifierSlack)
+	}
+	if len(n.Events) == 0 {
+		n.Events = []string{NotifyFailure, NotifyPoison}
+	}
+	for _, e := range n.Events {
+		switch e {
+		case NotifyFailure, NotifyPoison, NotifySuccess, NotifyDrift:
+		default:
+			return fmt.Errorf("notifiers.events must be %s, %s, %s or %s", NotifyFailure, NotifyPoison, NotifySuccess, NotifyDrift)
+		}
+	}
+	n.interval = DefaultNotifyInterval
+	if n.Interval != "" {
+		d, err := time.ParseDuration(n.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid notifiers.interval: %w", err)
+		}
+		// zero disables the rate limit and the deduplication, so it is not allowed
+		if d <= 0 {
+			return fmt.Errorf("notifiers.interval must be positive")
+		}
+		n.interval = d
+	}
+	if n.Burst < 0 {
+		return fmt.Errorf("notifiers.burst must not be negative")
+	} else if n.Burst == 0 {
+		n.Burst = DefaultNotifyBurst
+	}
+	return nil
+}
+
+func (n *NotifierConfig) accepts(event string) bool {
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification represents an event sent to notifiers.
+type Notification struct {
+	Event      string    `json:"event"`
+	MessageID  string    `json:"message_id"`
+	Target     string    `json:"target,omitempty"`
+	Table      string    `json:"table,omitempty"`
+	Record     string    `json:"record,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Processed  int       `json:"processed"`
+	Rows       int64     `json:"rows"`
+	Duration   float64   `json:"duration"`
+	Suppressed int       `json:"suppressed,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+func (n *Notification) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Rin] %s message %s", n.Event, n.MessageID)
+	if n.Target != "" {
+		fmt.Fprintf(&b, " target %s", n.Target)
+	}
+	if n.Table != "" {
+		fmt.Fprintf(&b, " table %s", n.Table)
+	}
+	if n.Record != "" {
+		fmt.Fprintf(&b, " record %s", n.Record)
+	}
+	fmt.Fprintf(&b, " processed %d (%d rows) in %.3fs", n.Processed, n.Rows, n.Duration)
+	if n.Error != "" {
+		fmt.Fprintf(&b, "\nerror: %s", n.Error)
+	}
+	if n.Suppressed > 0 {
+		fmt.Fprintf(&b, "\n(%d similar notifications were suppressed)", n.Suppressed)
+	}
+	return b.String()
+}
+
+// ImportError represents an error of the import for the target.
+type ImportError struct {
+	Target *Target
+	Record *EventRecord
+	Table  string // schema.table expanded for the record
+	Err    error
+}
+
+func newImportError(target *Target, record *EventRecord, capture *[]string, err error) *ImportError {
+	return &ImportError{Target: target, Record: record, Table: target.qualifiedTable(record, capture), Err: err}
+}
+
+func (e *ImportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// notifier sends notifications to a sink, rate-limited and deduplicated per target and table.
+// Notifications are sent in the background through a bounded queue, not to block workers by slow sinks.
+type notifier struct {
+	config *NotifierConfig
+	send   func(ctx context.Context, n *Notification) error
+	logger *log.Logger
+
+	queue   chan *Notification
+	pending sync.WaitGroup
+
+	mu         sync.Mutex
+	closed     bool
+	limiters   map[string]*rate.Limiter
+	sent       map[string]time.Time
+	suppressed map[string]int
+	seen       map[string]time.Time
+	pruned     time.Time
+}
+
+func (r *Rin) newNotifier(c *NotifierConfig) *notifier {
+	n := &notifier{
+		config:     c,
+		logger:     r.logger,
+		queue:      make(chan *Notification, NotifyQueueSize),
+		limiters:   make(map[string]*rate.Limiter),
+		sent:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		seen:       make(map[string]time.Time),
+	}
+	go n.run()
+	switch c.Type {
+	case NotifierWebhook:
+		n.send = func(ctx context.Context, m *Notification) error {
+			return postJSON(ctx, c.URL, m)
+		}
+	case NotifierSlack:
+		n.send = func(ctx context.Context, m *Notification) error {
+			return postJSON(ctx, c.URL, map[string]string{"text": m.String()})
+		}
+	case NotifierSNS:
+		n.send = func(ctx context.Context, m *Notification) error {
+			b, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			_, err = r.getSNSClient().Publish(ctx, &sns.PublishInput{
+				TopicArn: aws.String(c.TopicArn),
+				Subject:  aws.String(fmt.Sprintf("[Rin] %s %s", m.Event, m.Target)),
+				Message:  aws.String(string(b)),
+			})
+			return err
+		}
+	}
+	return n
+}
+
+// allow reports whether the notification should be sent. Notifications with the same error are sent once per interval,
+// and notifications for a target are limited to burst per interval.
+func (n *notifier) allow(m *Notification) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := m.Event + "\x00" + m.Target + "\x00" + m.Table
+	dedupKey := key + "\x00" + m.Error
+	now := m.Time
+	n.prune(now)
+	n.seen[key] = now
+	if m.Error != "" {
+		if t, ok := n.sent[dedupKey]; ok && now.Sub(t) < n.config.interval {
+			n.suppressed[key]++
+			return false
+		}
+	}
+	l := n.limiters[key]
+	if l == nil {
+		l = rate.NewLimiter(rate.Every(n.config.interval/time.Duration(n.config.Burst)), n.config.Burst)
+		n.limiters[key] = l
+	}
+	if !l.AllowN(now, 1) {
+		n.suppressed[key]++
+		return false
+	}
+	if m.Error != "" {
+		n.sent[dedupKey] = now
+	}
+	m.Suppressed = n.suppressed[key]
+	delete(n.suppressed, key)
+	return true
+}
+
+// prune removes the states of keys which were not notified in the interval, not to grow the maps by tables expanded from keys.
+// The limiters of them are full again, so removing them doesn't change the rate.
+func (n *notifier) prune(now time.Time) {
+	if now.Sub(n.pruned) < n.config.interval {
+		return
+	}
+	n.pruned = now
+	for key, t := range n.seen {
+		if now.Sub(t) >= n.config.interval {
+			delete(n.seen, key)
+			delete(n.limiters, key)
+			delete(n.suppressed, key)
+		}
+	}
+	for key, t := range n.sent {
+		if now.Sub(t) >= n.config.interval {
+			delete(n.sent, key)
+		}
+	}
+}
+
+// enqueue queues the notification to be sent. It returns false when the queue is full or the notifier is closed.
+func (n *notifier) enqueue(m *Notification) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return false
+	}
+	n.pending.Add(1)
+	select {
+	case n.queue <- m:
+		return true
+	default:
+		n.pending.Done()
+		return false
+	}
+}
+
+func (n *notifier) run() {
+	for m := range n.queue {
+		// notifications are sent even if the context of the message is canceled
+		ctx, cancel := context.WithTimeout(context.Background(), NotifyTimeout)
+		if err := n.send(ctx, m); err != nil {
+			n.logger.Printf("[warn] [%s] Failed to send %s notification to %s. %s", m.MessageID, m.Event, n.config.Type, err)
+		}
+		cancel()
+		n.pending.Done()
+	}
+}
+
+// close stops the notifier after the queued notifications are sent.
+func (n *notifier) close() {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	n.pending.Wait()
+}
+
+func postJSON(ctx context.Context, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("POST %s returned %s", url, res.Status)
+	}
+	return nil
+}
+
+// notify sends the notification to all notifiers which accept the event.
+func (r *Rin) notify(m *Notification) {
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	for _, n := range r.notifiers {
+		if !n.config.accepts(m.Event) {
+			continue
+		}
+		mc := *m
+		if !n.allow(&mc) {
+			r.logger.Printf("[debug] [%s] %s notification to %s was suppressed", m.MessageID, m.Event, n.config.Type)
+			continue
+		}
+		if !n.enqueue(&mc) {
+			r.logger.Printf("[warn] [%s] %s notification to %s was dropped because the queue is full or closed", m.MessageID, m.Event, n.config.Type)
+		}
+	}
+}
+
+// waitNotifications waits until the queued notifications are sent.
+func (r *Rin) waitNotifications() {
+	for _, n := range r.notifiers {
+		n.pending.Wait()
+	}
+}
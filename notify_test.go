@@ -0,0 +1,116 @@
+package rin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func notifyTestBody(key string) string {
+	return fmt.Sprintf(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":%q,"size":10}}}]}`, key)
+}
+
+func TestNotifiers(t *testing.T) {
+	rec := &notificationRecorder{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+	t.Setenv("RIN_TEST_WEBHOOK_URL", ts.URL)
+
+	imp := &failingImporter{}
+	r := newTestInstance(t, "test/config.notify.yml", withMemoryImporter(imp))
+	ctx := context.Background()
+
+	// success is sent only to the webhook
+	if err := r.ProcessMessage(ctx, "m1", notifyTestBody("notify/foo/1.json")); err != nil {
+		t.Fatal(err)
+	}
+	// poison message
+	if err := r.ProcessMessage(ctx, "m2", "broken"); err == nil {
+		t.Error("broken message must be failed")
+	}
+	// the same failures are deduplicated
+	imp.err = errors.New("table foo is broken")
+	for i := 0; i < 3; i++ {
+		r.ProcessMessage(ctx, fmt.Sprintf("m3-%d", i), notifyTestBody("notify/foo/2.json"))
+	}
+	// different failures for the table are rate limited by burst
+	for i := 0; i < 3; i++ {
+		imp.err = fmt.Errorf("table bar is broken %d", i)
+		r.ProcessMessage(ctx, fmt.Sprintf("m4-%d", i), notifyTestBody("notify/bar/1.json"))
+	}
+	// a new failure for foo reports the suppressed duplicates
+	imp.err = errors.New("table foo is broken again")
+	r.ProcessMessage(ctx, "m5", notifyTestBody("notify/foo/3.json"))
+	// Close waits for the queued notifications to be sent
+	r.Close()
+
+	events := []string{}
+	for _, m := range rec.webhook {
+		events = append(events, m.Event+" "+m.MessageID)
+	}
+	expected := "success m1,poison m2,failure m3-0,failure m4-0,failure m4-1,failure m5"
+	if strings.Join(events, ",") != expected {
+		t.Errorf("unexpected webhook notifications %v expected %s", events, expected)
+	}
+	if m := rec.webhook[2]; m.Table != "public.foo" || m.Error != "table foo is broken" {
+		t.Errorf("unexpected failure notification %#v", m)
+	}
+	if m := rec.webhook[5]; m.Suppressed != 2 {
+		t.Errorf("suppressed notifications must be counted %#v", m)
+	}
+	// slack accepts failure and poison by default, and the burst is 5
+	if len(rec.slack) != 6 {
+		t.Fatalf("unexpected slack notifications %v", rec.slack)
+	}
+	if !strings.Contains(rec.slack[5], "(2 similar notifications were suppressed)") {
+		t.Errorf("suppressed notifications must be counted: %s", rec.slack[5])
+	}
+}
+
+func TestNotifyAsync(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var received []*rin.Notification
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var m rin.Notification
+		json.NewDecoder(r.Body).Decode(&m)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, &m)
+	}))
+	defer ts.Close()
+	t.Setenv("RIN_TEST_WEBHOOK_URL", ts.URL)
+
+	r := newTestInstance(t, "test/config.notify.yml", withMemoryImporter(&reportingImporter{}))
+	// the worker is not blocked by the sink
+	done := make(chan error)
+	go func() {
+		done <- r.ProcessMessage(context.Background(), "m1", notifyTestBody("notify/foo/1.json"))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessMessage must not wait for notifications to be sent")
+	}
+	close(release)
+	r.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0].Event != rin.NotifySuccess || received[0].Rows != 42 {
+		t.Errorf("unexpected notifications %v", received)
+	}
+}
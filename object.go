@@ -0,0 +1,190 @@
+package rin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var attributePlaceHolder = regexp.MustCompile(`\$\{(metadata|tag):([^}]+)\}`)
+
+// ObjectAttributes represents user-defined metadata and tags of a S3 object.
+// A nil map means that it has not been fetched yet.
+type ObjectAttributes struct {
+	Metadata map[string]string
+	Tags     map[string]string
+}
+
+func (a *ObjectAttributes) lookup(kind, name string) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	var v string
+	var ok bool
+	switch kind {
+	case "metadata":
+		v, ok = a.Metadata[strings.ToLower(name)]
+	case "tag":
+		v, ok = a.Tags[name]
+	}
+	return v, ok
+}
+
+// quoted returns a copy of the attributes whose values are escaped to be embedded in SQL string literals.
+func (a *ObjectAttributes) quoted() *ObjectAttributes {
+	if a == nil {
+		return nil
+	}
+	escape := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		e := make(map[string]string, len(m))
+		for k, v := range m {
+			e[k] = escapeLiteral(v)
+		}
+		return e
+	}
+	return &ObjectAttributes{Metadata: escape(a.Metadata), Tags: escape(a.Tags)}
+}
+
+type attributeMatcher struct {
+	needMetadata bool
+	needTags     bool
+	metadata     map[string]*regexp.Regexp
+	tags         map[string]*regexp.Regexp
+}
+
+func (m *attributeMatcher) Match(attrs *ObjectAttributes) bool {
+	for name, reg := range m.metadata {
+		v, ok := attrs.lookup("metadata", name)
+		if !ok || !reg.MatchString(v) {
+			return false
+		}
+	}
+	for name, reg := range m.tags {
+		v, ok := attrs.lookup("tag", name)
+		if !ok || !reg.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Target) buildAttributeMatcher() error {
+	m := &attributeMatcher{
+		metadata: make(map[string]*regexp.Regexp, len(t.S3.Metadata)),
+		tags:     make(map[string]*regexp.Regexp, len(t.S3.Tags)),
+	}
+	for name, r := range t.S3.Metadata {
+		reg, err := regexp.Compile(r)
+		if err != nil {
+			return fmt.Errorf("target.metadata %s: %w", name, err)
+		}
+		// S3 returns user-defined metadata keys in lower case
+		m.metadata[strings.ToLower(name)] = reg
+		m.needMetadata = true
+	}
+	for name, r := range t.S3.Tags {
+		reg, err := regexp.Compile(r)
+		if err != nil {
+			return fmt.Errorf("target.tags %s: %w", name, err)
+		}
+		m.tags[name] = reg
+		m.needTags = true
+	}
+	if !t.Discard && t.Redshift != nil {
+		templates := append([]string{t.Redshift.Schema, t.Redshift.Table}, t.SQLBefore...)
+		templates = append(templates, t.SQLAfter...)
+		templates = append(templates, t.Columns...)
+		for _, s := range templates {
+			for _, sub := range attributePlaceHolder.FindAllStringSubmatch(s, -1) {
+				switch sub[1] {
+				case "metadata":
+					m.needMetadata = true
+				case "tag":
+					m.needTags = true
+				}
+			}
+		}
+	}
+	if (m.needMetadata || m.needTags) && t.OnRemove != nil {
+		return fmt.Errorf("target.on_remove can't be used with metadata or tags, because removed objects have no attributes")
+	}
+	if m.needMetadata || m.needTags {
+		t.attributeMatcher = m
+	}
+	return nil
+}
+
+// MatchObjectAttributes fetches the attributes of the object by svc if the target requires them, and matches them.
+func (t *Target) MatchObjectAttributes(ctx context.Context, svc *s3.Client, r *EventRecord) (bool, error) {
+	m := t.attributeMatcher
+	if m == nil {
+		return true, nil
+	}
+	if r.IsObjectRemoved() {
+		return false, nil
+	}
+	if err := r.fetchAttributes(ctx, svc, t.S3.Region, m.needMetadata, m.needTags); err != nil {
+		return false, err
+	}
+	return m.Match(r.Attributes), nil
+}
+
+func (r *EventRecord) fetchAttributes(ctx context.Context, svc *s3.Client, region string, metadata, tags bool) error {
+	if r.Attributes == nil {
+		r.Attributes = &ObjectAttributes{}
+	}
+	a := r.Attributes
+	bucket, key := r.S3.Bucket.Name, r.S3.Object.Key
+	optFn := func(o *s3.Options) {
+		if region != "" {
+			o.Region = region
+		}
+	}
+	if metadata && a.Metadata == nil {
+		res, err := svc.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}, optFn)
+		if err != nil {
+			return fmt.Errorf("failed to head object s3://%s/%s, %w", bucket, key, err)
+		}
+		a.Metadata = res.Metadata
+		if a.Metadata == nil {
+			a.Metadata = map[string]string{}
+		}
+	}
+	if tags && a.Tags == nil {
+		res, err := svc.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}, optFn)
+		if err != nil {
+			return fmt.Errorf("failed to get object tagging s3://%s/%s, %w", bucket, key, err)
+		}
+		a.Tags = make(map[string]string, len(res.TagSet))
+		for _, tag := range res.TagSet {
+			a.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return nil
+}
+
+func expandAttributes(s string, attrs *ObjectAttributes) (string, error) {
+	var err error
+	s = attributePlaceHolder.ReplaceAllStringFunc(s, func(p string) string {
+		sub := attributePlaceHolder.FindStringSubmatch(p)
+		v, ok := attrs.lookup(sub[1], sub[2])
+		if !ok && err == nil {
+			err = fmt.Errorf("%s %s is not found in the object", sub[1], sub[2])
+		}
+		return v
+	})
+	return s, err
+}
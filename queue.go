@@ -0,0 +1,266 @@
+package rin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Message is a message received from a queue.
+type Message struct {
+	ID            string
+	Body          string
+	GroupID       string // MessageGroupId of FIFO queues
+	ReceiptHandle string
+	ReceiveCount  int // ApproximateReceiveCount, or 0 if it is unknown
+}
+
+// MessageQueue is a source of messages for workers.
+type MessageQueue interface {
+	// Receive returns received messages. It returns NoMessageError when no messages are available.
+	Receive(ctx context.Context) ([]*Message, error)
+	// Ack removes the message which was processed successfully.
+	Ack(ctx context.Context, msg *Message) error
+	// Nack releases the message which was failed.
+	Nack(ctx context.Context, msg *Message) error
+}
+
+// Deferrer is implemented by queues which can deliver a message again after a delay.
+type Deferrer interface {
+	Defer(ctx context.Context, msg *Message, delay time.Duration) error
+}
+
+// sqsQueue receives messages from SQS. Failed messages are delivered again after the visibility timeout.
+type sqsQueue struct {
+	svc   *sqs.Client
+	queue *Queue
+	url   *string
+}
+
+func (r *Rin) newSQSQueue(ctx context.Context, q *Queue) (*sqsQueue, error) {
+	svc := r.getSQSClient()
+	r.logger.Println("[info] Connect to SQS:", q.Name)
+	res, err := svc.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(q.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sqsQueue{svc: svc, queue: q, url: res.QueueUrl}, nil
+}
+
+func (s *sqsQueue) Receive(ctx context.Context) ([]*Message, error) {
+	input := &sqs.ReceiveMessageInput{
+		MaxNumberOfMessages: s.queue.BatchSize,
+		WaitTimeSeconds:     s.queue.WaitTimeSeconds,
+		QueueUrl:            s.url,
+	}
+	input.AttributeNames = []types.QueueAttributeName{
+		types.QueueAttributeName(types.MessageSystemAttributeNameApproximateReceiveCount),
+	}
+	if s.queue.IsFIFO() {
+		input.AttributeNames = append(input.AttributeNames,
+			types.QueueAttributeName(types.MessageSystemAttributeNameMessageGroupId),
+		)
+	}
+	res, err := s.svc.ReceiveMessage(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Messages) == 0 {
+		return nil, NoMessageError{"No messages in " + s.queue.Name}
+	}
+	msgs := make([]*Message, 0, len(res.Messages))
+	for _, m := range res.Messages {
+		count, _ := strconv.Atoi(m.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+		msgs = append(msgs, &Message{
+			ID:            aws.ToString(m.MessageId),
+			Body:          aws.ToString(m.Body),
+			GroupID:       m.Attributes[string(types.MessageSystemAttributeNameMessageGroupId)],
+			ReceiptHandle: aws.ToString(m.ReceiptHandle),
+			ReceiveCount:  count,
+		})
+	}
+	return msgs, nil
+}
+
+func (s *sqsQueue) Ack(ctx context.Context, msg *Message) error {
+	_, err := s.svc.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      s.url,
+		ReceiptHandle: aws.String(msg.ReceiptHandle),
+	})
+	return err
+}
+
+func (s *sqsQueue) Nack(ctx context.Context, msg *Message) error {
+	// the message will be visible again after the visibility timeout
+	return nil
+}
+
+// Defer extends the visibility timeout of the message, or sends the message again with a delay and deletes it by defer of the queue.
+// The delay is limited by MaxVisibilityTimeout or MaxDelay. Messages deferred by more than the limits are deferred again when they are received.
+func (s *sqsQueue) Defer(ctx context.Context, msg *Message, delay time.Duration) error {
+	if s.queue.Defer == DeferRequeue {
+		if delay > MaxDelay {
+			delay = MaxDelay
+		}
+		if _, err := s.svc.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:     s.url,
+			MessageBody:  aws.String(msg.Body),
+			DelaySeconds: int32(ceilSeconds(delay)),
+		}); err != nil {
+			return err
+		}
+		return s.Ack(ctx, msg)
+	}
+	if delay > MaxVisibilityTimeout {
+		delay = MaxVisibilityTimeout
+	}
+	_, err := s.svc.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          s.url,
+		ReceiptHandle:     aws.String(msg.ReceiptHandle),
+		VisibilityTimeout: int32(ceilSeconds(delay)),
+	})
+	return err
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// LocalQueue reads S3 events from a file, files in a directory or stdin ("-"), and records acked and nacked messages.
+// Events are JSON values separated by newlines or whitespaces. Message ids are "{file}:{n}".
+type LocalQueue struct {
+	path string
+
+	mu     sync.Mutex
+	files  []string
+	file   io.ReadCloser
+	name   string
+	dec    *json.Decoder
+	n      int
+	acked  []*Message
+	nacked []*Message
+}
+
+// NewLocalQueue creates a LocalQueue for the path. "-" means stdin.
+func NewLocalQueue(path string) (*LocalQueue, error) {
+	q := &LocalQueue{path: path}
+	if path == "-" {
+		q.files = []string{path}
+		return q, nil
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		q.files = []string{path}
+		return q, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			q.files = append(q.files, filepath.Join(path, e.Name()))
+		}
+	}
+	sort.Strings(q.files)
+	return q, nil
+}
+
+// Receive returns the next event. It returns NoMessageError when all events have been read.
+func (q *LocalQueue) Receive(ctx context.Context) ([]*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.dec == nil {
+			if len(q.files) == 0 {
+				return nil, NoMessageError{"No messages in " + q.path}
+			}
+			if err := q.open(q.files[0]); err != nil {
+				return nil, err
+			}
+			q.files = q.files[1:]
+		}
+		var raw json.RawMessage
+		err := q.dec.Decode(&raw)
+		if err == io.EOF {
+			q.file.Close()
+			q.dec = nil
+			continue
+		} else if err != nil {
+			// the rest of the file is skipped
+			q.file.Close()
+			q.dec = nil
+			q.n++
+			q.nacked = append(q.nacked, &Message{ID: fmt.Sprintf("%s:%d", q.name, q.n)})
+			return nil, fmt.Errorf("failed to read events from %s, %w", q.name, err)
+		}
+		q.n++
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			return nil, err
+		}
+		return []*Message{{ID: fmt.Sprintf("%s:%d", q.name, q.n), Body: buf.String()}}, nil
+	}
+}
+
+func (q *LocalQueue) open(path string) error {
+	if path == "-" {
+		q.file, q.name = io.NopCloser(os.Stdin), "stdin"
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		q.file, q.name = f, path
+	}
+	q.dec = json.NewDecoder(q.file)
+	q.n = 0
+	return nil
+}
+
+// Ack records the message as acked.
+func (q *LocalQueue) Ack(ctx context.Context, msg *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.acked = append(q.acked, msg)
+	return nil
+}
+
+// Nack records the message as nacked.
+func (q *LocalQueue) Nack(ctx context.Context, msg *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nacked = append(q.nacked, msg)
+	return nil
+}
+
+// Acked returns the acked messages in order.
+func (q *LocalQueue) Acked() []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*Message{}, q.acked...)
+}
+
+// Nacked returns the nacked messages in order.
+func (q *LocalQueue) Nacked() []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*Message{}, q.nacked...)
+}
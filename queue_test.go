@@ -0,0 +1,107 @@
+package rin_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+	"github.com/fujiwara/Rin/rintest"
+)
+
+func TestLocalQueue(t *testing.T) {
+	ctx := context.Background()
+	q, err := rin.NewLocalQueue("test/local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for {
+		msgs, err := q.Receive(ctx)
+		if _, ok := err.(rin.NoMessageError); ok {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			if _, err := rin.ParseEvent([]byte(msg.Body)); err != nil {
+				t.Errorf("invalid event %s: %s", msg.ID, err)
+			}
+			ids = append(ids, msg.ID)
+			if len(ids) == 2 {
+				q.Nack(ctx, msg)
+			} else {
+				q.Ack(ctx, msg)
+			}
+		}
+	}
+	expected := []string{"test/local/1.json:1", "test/local/2.ndjson:1", "test/local/2.ndjson:2"}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected messages %v expected %v", ids, expected)
+	}
+	if acked, nacked := q.Acked(), q.Nacked(); len(acked) != 2 || len(nacked) != 1 || nacked[0].ID != expected[1] {
+		t.Errorf("unexpected acked %v nacked %v", acked, nacked)
+	}
+}
+
+func TestLocalQueueBroken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	if err := os.WriteFile(path, []byte(`{"Records":[]}`+"\n{broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	q, err := rin.NewLocalQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if msgs, err := q.Receive(ctx); err != nil || len(msgs) != 1 {
+		t.Fatalf("unexpected %v %v", msgs, err)
+	}
+	if _, err := q.Receive(ctx); err == nil {
+		t.Error("broken events must be failed")
+	}
+	if _, err := q.Receive(ctx); !errors.As(err, &rin.NoMessageError{}) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if nacked := q.Nacked(); len(nacked) != 1 || nacked[0].ID != path+":2" {
+		t.Errorf("broken events must be nacked %v", nacked)
+	}
+}
+
+func TestRunLocal(t *testing.T) {
+	db := rintest.NewDB()
+	db.Fail(`COPY "error_log"`, 1, errors.New("permission denied"))
+	var logs bytes.Buffer
+	r := newTestInstance(t, "test/config.rintest.yml",
+		rin.WithSessions(rintest.Sessions(nil, nil)),
+		rin.WithConnector(db),
+		rin.WithOption(&rin.Option{Local: "test/local", LocalQueue: "rin_logs"}),
+		rin.WithLogger(log.New(&logs, "", 0)),
+	)
+
+	if err := r.Run(context.Background()); err == nil || err.Error() != "1 messages were failed" {
+		t.Errorf("unexpected error %v", err)
+	}
+	var copies int
+	for _, s := range db.Statements() {
+		if strings.HasPrefix(s, "/* Rin */ COPY") {
+			copies++
+		}
+	}
+	if copies != 3 {
+		t.Errorf("unexpected statements %v", db.Statements())
+	}
+	for _, s := range []string{
+		"2 messages were acked and 1 messages were nacked from test/local",
+		"[warn] [test/local/2.ndjson:1] Nacked message",
+	} {
+		if !strings.Contains(logs.String(), s) {
+			t.Errorf("logs must contain %s", s)
+		}
+	}
+}
@@ -3,22 +3,40 @@ package rin
 import (
 	"context"
 	"database/sql"
-	"log"
-	"strings"
+	"database/sql/driver"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/redshift"
-	_ "github.com/lib/pq"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftserverless"
+	"github.com/lib/pq"
 	_ "github.com/mashiike/redshift-data-sql-driver"
 )
 
+// DBPool and DBPoolMutex hold connections of the instance started by Run, RunWithContext and DryRun, by DSN.
+//
+// Deprecated: connections are owned by instances, and closed by Close of the instance.
 var (
 	DBPool      = make(map[string]*sql.DB, 0)
 	DBPoolMutex sync.Mutex
-	redshiftSvc *redshift.Client
 )
 
+// publishDB records the connection of the default instance to DBPool. A nil db removes it.
+func (r *Rin) publishDB(rs *Redshift, db *sql.DB) {
+	if r != defaultInstance {
+		return
+	}
+	DBPoolMutex.Lock()
+	defer DBPoolMutex.Unlock()
+	if db == nil {
+		delete(DBPool, rs.DSN())
+	} else {
+		DBPool[rs.DSN()] = db
+	}
+}
+
 func BoolValue(b *bool) bool {
 	if b != nil {
 		return *b
@@ -26,150 +44,453 @@ func BoolValue(b *bool) bool {
 	return false
 }
 
-func Import(ctx context.Context, event Event) (int, error) {
-	var processed int
+// Import imports the event into all targets of the configuration, and returns the results of matched records.
+// The import is not retried, so on_failure actions run when it fails.
+func (r *Rin) Import(ctx context.Context, event Event) (ImportResults, error) {
+	return r.importTargets(ctx, event, r.config.Targets, "", true)
+}
+
+// importTargets imports the records of the event into the matched targets.
+// on_success actions run after all records were imported, and on_failure actions run only when final is true, not to run them for each attempt of the message.
+func (r *Rin) importTargets(ctx context.Context, event Event, targets []*Target, msgId string, final bool) (results ImportResults, err error) {
+	reqs, failed, err := r.matchTargets(ctx, event, targets, msgId)
+	if err != nil {
+		results = ImportResults{failed.Result}
+		r.writeAudit(msgId, results)
+		return results, err
+	}
+	if err := checkLoadWindows(reqs, time.Now()); err != nil {
+		return nil, err
+	}
+	defer func() {
+		r.writeAudit(msgId, results)
+	}()
+	var succeeded []*ImportRequest
+	for _, req := range reqs {
+		target, record, result := req.Target, req.Record, req.Result
+		if target.Discard {
+			results = append(results, result)
+			continue
+		}
+		r.state.addTarget(msgId, target)
+		imp := r.importers[target]
+		var err error
+		if record.IsObjectRemoved() {
+			result.Outcome = OutcomeRemoved
+			err = imp.(Remover).Remove(ctx, req)
+		} else {
+			result.Outcome = OutcomeImported
+			err = imp.Import(ctx, req)
+			if err != nil && final && ctx.Err() == nil {
+				r.runObjectActions(ctx, req, target.OnFailure, "on_failure")
+			} else if err == nil && target.OnSuccess != nil {
+				succeeded = append(succeeded, req)
+			}
+		}
+		result.Duration = time.Since(result.Time)
+		if err != nil {
+			result.Outcome, result.Error = OutcomeFailed, err.Error()
+			return append(results, result), newImportError(target, record, req.Capture, err)
+		}
+		results = append(results, result)
+	}
+	r.runSuccessActions(ctx, succeeded)
+	return results, nil
+}
+
+// matchTargets returns requests of the records for the matched targets in order, by keys, event names and attributes of objects.
+// A record is not matched with the following targets after a target with discard or break. Requests for discarded records have the discarded outcome.
+// When attributes of an object can't be matched, it returns the failed request with the error.
+func (r *Rin) matchTargets(ctx context.Context, event Event, targets []*Target, msgId string) (reqs []*ImportRequest, failed *ImportRequest, err error) {
 	for _, record := range event.Records {
-	TARGETS:
-		for _, target := range config.Targets {
-			if ok, cap := target.MatchEventRecord(record); ok {
-				if target.Discard {
-					processed++
-					break TARGETS
-				}
-				err := target.ImportRedshift(ctx, record, cap)
-				if err != nil {
-					if BoolValue(config.Redshift.ReconnectOnError) {
-						target.DisconnectToRedshift()
-					}
-					return processed, err
-				} else {
-					processed++
-				}
-				if target.Break {
-					break TARGETS
-				}
+		for _, target := range targets {
+			ok, cap := target.MatchEventRecord(record)
+			if !ok {
+				continue
+			}
+			result := newImportResult(msgId, target, record, cap)
+			if ok, err := target.MatchObjectAttributes(ctx, r.getS3Client(), record); err != nil {
+				result.Outcome, result.Error = OutcomeFailed, err.Error()
+				failed = &ImportRequest{Target: target, Record: record, Capture: cap, MessageID: msgId, Result: result}
+				return nil, failed, newImportError(target, record, cap, err)
+			} else if !ok {
+				continue
+			}
+			if target.Discard {
+				result.Outcome = OutcomeDiscarded
+			}
+			reqs = append(reqs, &ImportRequest{Target: target, Record: record, Capture: cap, MessageID: msgId, Result: result})
+			if target.Discard || target.Break {
+				break
 			}
 		}
 	}
-	return processed, nil
+	return reqs, nil, nil
 }
 
-func (target *Target) DisconnectToRedshift() {
-	r := target.Redshift
-	dsn := r.DSN()
-	log.Println("[info] Disconnect to Redshift", r.VisibleDSN())
+// redshiftImporter imports S3 objects by COPY query on Redshift.
+type redshiftImporter struct {
+	rin *Rin
+}
 
-	DBPoolMutex.Lock()
-	defer DBPoolMutex.Unlock()
+func newRedshiftImporter(r *Rin, target *Target) (Importer, error) {
+	return &redshiftImporter{rin: r}, nil
+}
+
+func (i *redshiftImporter) Import(ctx context.Context, req *ImportRequest) error {
+	err := i.rin.importRedshift(ctx, req)
+	i.reconnectOnError(req.Target, err)
+	return err
+}
 
-	if db := DBPool[dsn]; db != nil {
-		db.Close()
+func (i *redshiftImporter) Remove(ctx context.Context, req *ImportRequest) error {
+	err := i.rin.deleteRedshift(ctx, req)
+	i.reconnectOnError(req.Target, err)
+	return err
+}
+
+func (i *redshiftImporter) reconnectOnError(target *Target, err error) {
+	if err != nil && target.Redshift.Driver != DriverRedshiftData && BoolValue(i.rin.config.Redshift.ReconnectOnError) {
+		i.rin.disconnectToRedshift(target)
 	}
-	delete(DBPool, dsn)
 }
 
+// DisconnectToRedshift closes the connection of the instance started by Run.
+func (target *Target) DisconnectToRedshift() {
+	defaultInstance.disconnectToRedshift(target)
+}
+
+// ConnectToRedshift returns the connection of the instance started by Run.
 func (target *Target) ConnectToRedshift(ctx context.Context) (*sql.DB, error) {
-	r := target.Redshift
-	dsn := r.DSN()
+	return defaultInstance.connectToRedshift(ctx, target)
+}
 
-	DBPoolMutex.Lock()
-	defer DBPoolMutex.Unlock()
+// ImportRedshift imports the record by the instance started by Run.
+func (target *Target) ImportRedshift(ctx context.Context, record *EventRecord, cap *[]string) error {
+	return defaultInstance.importRedshift(ctx, &ImportRequest{Target: target, Record: record, Capture: cap})
+}
 
-	if db := DBPool[dsn]; db != nil {
-		if db.Ping() == nil {
-			return db, nil
-		} else {
-			delete(DBPool, dsn)
-		}
+// DeleteRedshift deletes rows for the removed record by the instance started by Run.
+func (target *Target) DeleteRedshift(ctx context.Context, record *EventRecord, cap *[]string) error {
+	return defaultInstance.deleteRedshift(ctx, &ImportRequest{Target: target, Record: record, Capture: cap})
+}
+
+// dbPoolEntry holds a connection pool for a credential identity.
+// Connecting to an identity does not block workers which use other identities.
+type dbPoolEntry struct {
+	mu sync.Mutex
+	db *sql.DB
+	rs *Redshift
+}
+
+func (r *Rin) dbPoolEntry(key string) *dbPoolEntry {
+	r.dbPoolMutex.Lock()
+	defer r.dbPoolMutex.Unlock()
+	e := r.dbPool[key]
+	if e == nil {
+		e = &dbPoolEntry{}
+		r.dbPool[key] = e
+	}
+	return e
+}
+
+func (r *Rin) disconnectToRedshift(target *Target) {
+	rs := target.Redshift
+	r.logger.Println("[info] Disconnect to Redshift", rs.VisibleDSN())
+
+	e := r.dbPoolEntry(rs.Identity())
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.db != nil {
+		e.db.Close()
+		e.db = nil
+		r.publishDB(rs, nil)
+	}
+}
+
+func (r *Rin) connectToRedshift(ctx context.Context, target *Target) (*sql.DB, error) {
+	rs := target.Redshift
+	e := r.dbPoolEntry(rs.Identity())
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.db != nil {
+		// database/sql discards broken connections by itself
+		return e.db, nil
 	}
-	log.Println("[info] Connect to Redshift", r.VisibleDSN())
+	r.logger.Println("[info] Connect to Redshift", rs.VisibleDSN())
 
-	var user, password = r.User, r.Password
-	// redshift-data driver creates a temporary credentials by itself
-	if password == "" && r.Driver != DriverRedshiftData {
-		if redshiftSvc == nil {
-			redshiftSvc = redshift.NewFromConfig(*Sessions.Redshift, Sessions.RedshiftOptFns...)
+	var db *sql.DB
+	switch {
+	case rs.Driver == DriverRedshiftData:
+		// redshift-data driver creates a temporary credentials by itself.
+		var err error
+		db, err = sql.Open(rs.Driver, rs.DSN())
+		if err != nil {
+			return nil, err
 		}
-		id := strings.SplitN(r.Host, ".", 2)[0]
-		log.Printf("[info] Getting cluster credentials for %s user %s", r.Host, r.User)
-		res, err := redshiftSvc.GetClusterCredentials(ctx, &redshift.GetClusterCredentialsInput{
-			ClusterIdentifier: aws.String(id),
-			DbUser:            aws.String(r.User),
-		})
+	case r.connector != nil:
+		db = sql.OpenDB(r.connector)
+	case rs.CredentialsAPI() != "":
+		// connections are opened with temporary credentials which are refreshed before they expire
+		db = sql.OpenDB(&temporaryCredentialsConnector{rin: r, rs: rs})
+	default:
+		var err error
+		db, err = sql.Open(rs.Driver, rs.DSN())
 		if err != nil {
 			return nil, err
 		}
-		user, password = *res.DbUser, *res.DbPassword
-		log.Printf("[debug] Got user %s password %s", user, password)
 	}
+	db.SetMaxOpenConns(rs.MaxOpenConns)
+	if rs.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(rs.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(rs.connMaxLifetime)
+	db.SetConnMaxIdleTime(rs.connMaxIdleTime)
+	e.db, e.rs = db, rs
+	r.publishDB(rs, db)
+	return db, nil
+}
+
+// temporaryCredentialsConnector opens connections with temporary credentials.
+type temporaryCredentialsConnector struct {
+	rin *Rin
+	rs  *Redshift
+
+	mu         sync.Mutex
+	connector  *pq.Connector
+	expiration time.Time
+}
 
-	db, err := sql.Open(r.Driver, r.DSNWith(user, password))
+func (c *temporaryCredentialsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	connector, err := c.getConnector(ctx)
 	if err != nil {
 		return nil, err
 	}
-	DBPool[dsn] = db
-	return db, nil
+	return connector.Connect(ctx)
 }
 
-func (target *Target) ImportRedshift(ctx context.Context, record *EventRecord, cap *[]string) error {
-	if config.Redshift.UseTransaction() {
-		return target.importRedshiftWithTx(ctx, record, cap)
-	} else {
-		return target.importRedshiftWithoutTx(ctx, record, cap)
+func (c *temporaryCredentialsConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+func (c *temporaryCredentialsConnector) getConnector(ctx context.Context) (*pq.Connector, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connector != nil && time.Until(c.expiration) > c.rs.credentialsRefreshMargin {
+		return c.connector, nil
+	}
+	user, password, expiration, err := c.rin.getTemporaryCredentials(ctx, c.rs)
+	if err != nil {
+		return nil, err
+	}
+	c.rin.logger.Printf("[debug] Got user %s expiration %s", user, expiration)
+	connector, err := pq.NewConnector(c.rs.DSNWith(user, password))
+	if err != nil {
+		return nil, err
+	}
+	c.connector, c.expiration = connector, expiration
+	return connector, nil
+}
+
+func (r *Rin) getTemporaryCredentials(ctx context.Context, rs *Redshift) (string, string, time.Time, error) {
+	var duration *int32
+	if rs.DurationSeconds > 0 {
+		duration = aws.Int32(rs.DurationSeconds)
+	}
+	var dbName *string
+	if rs.DBName != "" {
+		dbName = aws.String(rs.DBName)
+	}
+	api := rs.CredentialsAPI()
+	switch api {
+	case CredentialsAPIGetCredentials:
+		r.logger.Printf("[info] Getting credentials for workgroup %s by %s", rs.Workgroup, api)
+		res, err := r.getRedshiftServerlessClient().GetCredentials(ctx, &redshiftserverless.GetCredentialsInput{
+			WorkgroupName:   aws.String(rs.Workgroup),
+			DbName:          dbName,
+			DurationSeconds: duration,
+		})
+		if err != nil {
+			return "", "", time.Time{}, err
+		}
+		return aws.ToString(res.DbUser), aws.ToString(res.DbPassword), aws.ToTime(res.Expiration), nil
+	case CredentialsAPIGetClusterCredentialsWithIAM:
+		r.logger.Printf("[info] Getting cluster credentials for %s by %s", rs.ClusterID(), api)
+		res, err := r.getRedshiftClient().GetClusterCredentialsWithIAM(ctx, &redshift.GetClusterCredentialsWithIAMInput{
+			ClusterIdentifier: aws.String(rs.ClusterID()),
+			DbName:            dbName,
+			DurationSeconds:   duration,
+		})
+		if err != nil {
+			return "", "", time.Time{}, err
+		}
+		return aws.ToString(res.DbUser), aws.ToString(res.DbPassword), aws.ToTime(res.Expiration), nil
+	default:
+		r.logger.Printf("[info] Getting cluster credentials for %s user %s by %s", rs.ClusterID(), rs.User, api)
+		res, err := r.getRedshiftClient().GetClusterCredentials(ctx, &redshift.GetClusterCredentialsInput{
+			ClusterIdentifier: aws.String(rs.ClusterID()),
+			DbUser:            aws.String(rs.User),
+			DbName:            dbName,
+			DurationSeconds:   duration,
+			AutoCreate:        rs.AutoCreate,
+			DbGroups:          rs.DbGroups,
+		})
+		if err != nil {
+			return "", "", time.Time{}, err
+		}
+		return aws.ToString(res.DbUser), aws.ToString(res.DbPassword), aws.ToTime(res.Expiration), nil
 	}
 }
 
-func (target *Target) importRedshiftWithTx(ctx context.Context, record *EventRecord, cap *[]string) error {
-	log.Printf("[info] Import to target %s from record %s", target, record)
-	db, err := target.ConnectToRedshift(ctx)
+func (r *Rin) importRedshift(ctx context.Context, req *ImportRequest) error {
+	r.logger.Printf("[info] Import to target %s from record %s", req.Target, req.Record)
+	query, err := req.Target.BuildCopySQLForRecord(req.Record, r.config.Credentials, req.Capture)
 	if err != nil {
 		return err
 	}
-	txn, err := db.Begin()
+	stmts, err := req.Target.BuildStatements(req.Record, req.Capture, query)
 	if err != nil {
 		return err
 	}
-	defer txn.Rollback()
-
-	query, err := target.BuildCopySQL(record.S3.Object.Key, config.Credentials, cap)
+	table, err := req.Target.tableName(req.Capture, req.Record.Attributes)
 	if err != nil {
 		return err
 	}
-	log.Println("[debug] SQL:", query)
-
-	stmt, err := txn.Prepare(query)
+	// the table is created and altered in the lock of the table
+	release, err := r.throttle.acquire(ctx, req.Target, table)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec()
+	defer release()
+	if req.Target.CreateTable != nil {
+		if err := r.createTable(ctx, req, table); err != nil {
+			return err
+		}
+	}
+	if req.Target.SchemaDrift != nil {
+		if err := r.checkSchemaDrift(ctx, req, table); err != nil {
+			return err
+		}
+	}
+	rows, err := r.execRedshift(ctx, req.Target, req.MessageID, stmts, len(req.Target.SQLBefore))
+	req.Report(rows, stmts...)
 	if err != nil {
 		return err
 	}
+	if rows >= 0 {
+		r.logger.Printf("[info] [%s] %d rows loaded into %s from %s", req.MessageID, rows, table, req.Record)
+	}
+	return nil
+}
 
-	err = txn.Commit()
+func (r *Rin) deleteRedshift(ctx context.Context, req *ImportRequest) error {
+	r.logger.Printf("[info] Delete from target %s by record %s", req.Target, req.Record)
+	query, err := req.Target.BuildDeleteSQL(req.Capture)
+	if err != nil {
+		return err
+	}
+	table, err := req.Target.tableName(req.Capture, req.Record.Attributes)
+	if err != nil {
+		return err
+	}
+	release, err := r.throttle.acquire(ctx, req.Target, table)
+	if err != nil {
+		return err
+	}
+	defer release()
+	rows, err := r.execRedshift(ctx, req.Target, req.MessageID, []string{query}, -1)
 	if err != nil {
 		return err
 	}
+	req.Report(rows, query)
+	return nil
+}
+
+// execRedshift executes the statements in a transaction.
+// It returns the number of rows loaded by the COPY statement at copyIndex, or -1 if copyIndex is negative or it is unknown.
+func (r *Rin) execRedshift(ctx context.Context, target *Target, msgId string, stmts []string, copyIndex int) (int64, error) {
+	if target.Redshift.Driver == DriverRedshiftData {
+		if copyIndex < 0 || !target.NonEmpty {
+			return r.execDataAPI(ctx, target, msgId, stmts, copyIndex)
+		}
+		// the batch fails and is rolled back by the check following COPY, before sql_after runs
+		checkIndex := copyIndex + 1
+		batch := make([]string, 0, len(stmts)+1)
+		batch = append(batch, stmts[:checkIndex]...)
+		batch = append(batch, NonEmptyCheckSQL)
+		batch = append(batch, stmts[checkIndex:]...)
+		rows, err := r.execDataAPI(ctx, target, msgId, batch, copyIndex)
+		if serr := (*StatementError)(nil); errors.As(err, &serr) && serr.Index == checkIndex {
+			return 0, EmptyLoadError{}
+		}
+		return rows, err
+	}
+	return r.execRedshiftWithTx(ctx, target, stmts, copyIndex)
+}
+
+// NonEmptyCheckSQL fails by division by zero when the last COPY in the session loaded no rows.
+// The redshift-data driver runs it after COPY of non_empty targets in the batch.
+const NonEmptyCheckSQL = "/* Rin */ SELECT 1 / CASE WHEN pg_last_copy_count() > 0 THEN 1 ELSE 0 END"
+
+// EmptyLoadError is returned when no rows were loaded into a target with non_empty.
+type EmptyLoadError struct{}
+
+func (e EmptyLoadError) Error() string {
+	return "no rows were loaded into the non_empty target"
+}
+
+// CheckLoadedRows returns EmptyLoadError when the target is non_empty and no rows were loaded. Unknown rows (-1) are not checked.
+func (t *Target) CheckLoadedRows(rows int64) error {
+	if t.NonEmpty && rows == 0 {
+		return EmptyLoadError{}
+	}
 	return nil
 }
 
-func (target *Target) importRedshiftWithoutTx(ctx context.Context, record *EventRecord, cap *[]string) error {
-	log.Printf("[info] Import to target %s from record %s", target, record)
-	db, err := target.ConnectToRedshift(ctx)
+// execPrepared executes the query as a prepared statement.
+// pq sends prepared statements by the extended query protocol, which rejects multiple statements in a query.
+func execPrepared(txn *sql.Tx, query string) error {
+	stmt, err := txn.Prepare(query)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
+	_, err = stmt.Exec()
+	return err
+}
 
-	query, err := target.BuildCopySQL(record.S3.Object.Key, config.Credentials, cap)
+func (r *Rin) execRedshiftWithTx(ctx context.Context, target *Target, stmts []string, copyIndex int) (int64, error) {
+	db, err := r.connectToRedshift(ctx, target)
 	if err != nil {
-		return err
+		return -1, err
 	}
-	log.Println("[debug] SQL:", query)
+	txn, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer txn.Rollback()
 
-	if _, err := db.Exec(query); err != nil {
-		return err
+	var rows int64 = -1
+	for i, query := range stmts {
+		r.logger.Println("[debug] SQL:", query)
+		if err := execPrepared(txn, query); err != nil {
+			return -1, err
+		}
+		if i == copyIndex {
+			// pg_last_copy_count returns the rows loaded by the last COPY in the session
+			if err := txn.QueryRow("SELECT pg_last_copy_count()").Scan(&rows); err != nil {
+				return -1, err
+			}
+			// rollback the transaction
+			if err := target.CheckLoadedRows(rows); err != nil {
+				return rows, err
+			}
+		}
 	}
 
-	return nil
+	err = txn.Commit()
+	if err != nil {
+		return -1, err
+	}
+	return rows, nil
 }
@@ -2,7 +2,9 @@ package rin
 
 import (
 	"context"
+	"database/sql/driver"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -16,29 +18,45 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/redshift"
 	"github.com/aws/aws-sdk-go-v2/service/redshiftdata"
+	"github.com/aws/aws-sdk-go-v2/service/redshiftserverless"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	redshiftdatasqldriver "github.com/mashiike/redshift-data-sql-driver"
 )
 
-var config *Config
+// MaxDeleteRetry and Sessions are the defaults for instances created by the top-level functions.
 var MaxDeleteRetry = 8
 var Sessions *SessionStore
 
+// defaultInstance is the instance created by Run, RunWithContext and DryRun.
+var defaultInstance *Rin
+
 type Option struct {
 	MaxExecutionTime time.Duration `json:"max_execution_time"`
 	BatchMode        bool          `json:"batch_mode"`
+	Local            string        `json:"local"`       // path of events to read instead of SQS. "-" means stdin
+	LocalQueue       string        `json:"local_queue"` // name of the queue which targets are used for local events
 }
 
 func (o *Option) String() string {
-	return strings.Join([]string{
+	opts := []string{
 		"MaxExecutionTime: " + o.MaxExecutionTime.String(),
 		fmt.Sprintf("BatchMode: %v", o.BatchMode),
-	}, ", ")
+	}
+	if o.Local != "" {
+		opts = append(opts, "Local: "+o.Local)
+	}
+	if o.LocalQueue != "" {
+		opts = append(opts, "LocalQueue: "+o.LocalQueue)
+	}
+	return strings.Join(opts, ", ")
 }
 
 func init() {
 	Sessions = &SessionStore{}
+	// Statements of instances are executed by the Data API client of each instance.
+	// The driver is used only by Target.ConnectToRedshift for redshift-data targets.
 	redshiftdatasqldriver.RedshiftDataClientConstructor = func(ctx context.Context, cfg *redshiftdatasqldriver.RedshiftDataConfig) (redshiftdatasqldriver.RedshiftDataClient, error) {
 		return redshiftdata.NewFromConfig(*Sessions.Redshift, cfg.RedshiftDataOptFns...), nil
 	}
@@ -51,6 +69,8 @@ type SessionStore struct {
 	RedshiftOptFns []func(*redshift.Options)
 	S3             *aws.Config
 	S3OptFns       []func(*s3.Options)
+	SNS            *aws.Config // for SNS notifiers. SQS is used if nil
+	SNSOptFns      []func(*sns.Options)
 }
 
 var TrapSignals = []os.Signal{
@@ -74,17 +94,277 @@ func (e MaxExecutionTimeReachedError) Error() string {
 	return "max execution time reached"
 }
 
+// Rin is an importer instance. It owns a configuration, AWS clients, connections to Redshift and a logger.
+type Rin struct {
+	config         *Config
+	option         *Option
+	sessions       *SessionStore
+	logger         *log.Logger
+	maxDeleteRetry int
+
+	dbPool      map[string]*dbPoolEntry
+	dbPoolMutex sync.Mutex
+	connector   driver.Connector
+
+	importerFactories map[string]ImporterFactory
+	importers         map[*Target]Importer
+
+	clientMutex     sync.Mutex
+	redshiftSvc     *redshift.Client
+	serverlessSvc   *redshiftserverless.Client
+	snsSvc          *sns.Client
+	redshiftDataSvc RedshiftDataClient
+	s3Svc           *s3.Client
+	sqsSvc          *sqs.Client
+
+	statements *statementTracker
+	throttle   *throttle
+	notifiers  []*notifier
+	state      *workerState
+
+	auditTarget *Target
+	tables      tableCache
+	columns     columnCache
+}
+
+type InstanceOption func(*Rin)
+
+// WithSessions sets AWS configurations. When it is not set or SQS is nil, they are loaded by the credentials in the configuration.
+func WithSessions(s *SessionStore) InstanceOption {
+	return func(r *Rin) {
+		r.sessions = s
+	}
+}
+
+// WithLogger sets a logger. The default is the standard logger.
+func WithLogger(l *log.Logger) InstanceOption {
+	return func(r *Rin) {
+		r.logger = l
+	}
+}
+
+// WithOption sets options for running workers.
+func WithOption(opt *Option) InstanceOption {
+	return func(r *Rin) {
+		r.option = opt
+	}
+}
+
+// WithMaxDeleteRetry sets max retry count to delete SQS messages.
+func WithMaxDeleteRetry(n int) InstanceOption {
+	return func(r *Rin) {
+		r.maxDeleteRetry = n
+	}
+}
+
+// WithConnector sets a connector to open connections to Redshift instead of the driver of the configuration.
+// It is used for testing by a fake driver. Targets with the redshift-data driver are not affected.
+func WithConnector(c driver.Connector) InstanceOption {
+	return func(r *Rin) {
+		r.connector = c
+	}
+}
+
+// New creates a Rin instance for the configuration.
+func New(cfg *Config, opts ...InstanceOption) (*Rin, error) {
+	r := &Rin{
+		config:         cfg,
+		option:         &Option{},
+		logger:         log.Default(),
+		maxDeleteRetry: MaxDeleteRetry,
+		dbPool:         make(map[string]*dbPoolEntry),
+		throttle:       newThrottle(),
+		state:          newWorkerState(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.sessions == nil {
+		r.sessions = &SessionStore{}
+	}
+	if err := r.sessions.setup(context.Background(), cfg.Credentials); err != nil {
+		return nil, err
+	}
+	if err := r.setupImporters(); err != nil {
+		return nil, err
+	}
+	var stateFile string
+	if cfg.RedshiftData != nil {
+		stateFile = cfg.RedshiftData.StateFile
+	}
+	statements, err := newStatementTracker(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	r.statements = statements
+	for _, c := range cfg.Notifiers {
+		r.notifiers = append(r.notifiers, r.newNotifier(c))
+	}
+	if cfg.Audit != nil && cfg.Audit.Type == AuditRedshift {
+		r.auditTarget = cfg.auditTarget()
+	}
+	for _, s := range statements.list() {
+		r.logger.Printf("[info] [%s] Statement %s for %s is tracked. It will be resumed when the message is redelivered.", s.MessageID, s.ID, s.Target)
+	}
+	return r, nil
+}
+
+func (s *SessionStore) setup(ctx context.Context, cred Credentials) error {
+	if s.SQS != nil {
+		return nil
+	}
+	opts := []func(*awsConfig.LoadOptions) error{
+		awsConfig.WithRegion(cred.AWS_REGION),
+	}
+	if cred.AWS_ACCESS_KEY_ID != "" {
+		opts = append(opts, awsConfig.WithCredentialsProvider(credentials.StaticCredentialsProvider{
+			Value: aws.Credentials{
+				AccessKeyID:     cred.AWS_ACCESS_KEY_ID,
+				SecretAccessKey: cred.AWS_SECRET_ACCESS_KEY,
+				Source:          "from Rin config",
+			},
+		}))
+	}
+	c, err := awsConfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	s.SQS = &c
+	s.SQSOptFns = make([]func(*sqs.Options), 0)
+	s.Redshift = &c
+	s.RedshiftOptFns = make([]func(*redshift.Options), 0)
+	s.S3 = &c
+	s.S3OptFns = make([]func(*s3.Options), 0)
+	s.SNS = &c
+	s.SNSOptFns = make([]func(*sns.Options), 0)
+	return nil
+}
+
+// Config returns the configuration of the instance.
+func (r *Rin) Config() *Config {
+	return r.config
+}
+
+// Logger returns the logger of the instance.
+func (r *Rin) Logger() *log.Logger {
+	return r.logger
+}
+
+// Close closes all connections to Redshift, and stops notifiers after the queued notifications are sent.
+func (r *Rin) Close() error {
+	for _, n := range r.notifiers {
+		n.close()
+	}
+	r.dbPoolMutex.Lock()
+	defer r.dbPoolMutex.Unlock()
+	var err error
+	for key, entry := range r.dbPool {
+		entry.mu.Lock()
+		if entry.db != nil {
+			if e := entry.db.Close(); e != nil {
+				err = e
+			}
+			entry.db = nil
+			r.publishDB(entry.rs, nil)
+		}
+		entry.mu.Unlock()
+		delete(r.dbPool, key)
+	}
+	for _, imp := range r.importers {
+		if c, ok := imp.(io.Closer); ok {
+			if e := c.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (r *Rin) getRedshiftClient() *redshift.Client {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	if r.redshiftSvc == nil {
+		r.redshiftSvc = redshift.NewFromConfig(*r.sessions.Redshift, r.sessions.RedshiftOptFns...)
+	}
+	return r.redshiftSvc
+}
+
+func (r *Rin) getSNSClient() *sns.Client {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	if r.snsSvc == nil {
+		cfg := r.sessions.SNS
+		if cfg == nil {
+			cfg = r.sessions.SQS
+		}
+		r.snsSvc = sns.NewFromConfig(*cfg, r.sessions.SNSOptFns...)
+	}
+	return r.snsSvc
+}
+
+func (r *Rin) getRedshiftServerlessClient() *redshiftserverless.Client {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	if r.serverlessSvc == nil {
+		r.serverlessSvc = redshiftserverless.NewFromConfig(*r.sessions.Redshift)
+	}
+	return r.serverlessSvc
+}
+
+func (r *Rin) getRedshiftDataClient() RedshiftDataClient {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	if r.redshiftDataSvc == nil {
+		r.redshiftDataSvc = redshiftdata.NewFromConfig(*r.sessions.Redshift)
+	}
+	return r.redshiftDataSvc
+}
+
+func (r *Rin) getS3Client() *s3.Client {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	if r.s3Svc == nil {
+		r.s3Svc = s3.NewFromConfig(*r.sessions.S3, r.sessions.S3OptFns...)
+	}
+	return r.s3Svc
+}
+
+func (r *Rin) getSQSClient() *sqs.Client {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	if r.sqsSvc == nil {
+		r.sqsSvc = sqs.NewFromConfig(*r.sessions.SQS, r.sessions.SQSOptFns...)
+	}
+	return r.sqsSvc
+}
+
+func (r *Rin) logTargets() {
+	for _, target := range r.config.Targets {
+		r.logger.Println("[info] Define target", target.String())
+	}
+	for _, q := range r.config.Queues {
+		r.logger.Println("[info] Define queue", q.String())
+	}
+}
+
 func DryRun(configFile string, opt *Option) error {
 	ctx := context.Background()
-	var err error
 	log.Println("[info] Loading config:", configFile)
-	config, err = LoadConfig(ctx, configFile)
+	config, err := LoadConfig(ctx, configFile)
 	if err != nil {
 		return err
 	}
-	for _, target := range config.Targets {
-		log.Println("[info] Define target", target.String())
+	r, err := New(config,
+		WithSessions(Sessions),
+		WithOption(opt),
+	)
+	if err != nil {
+		return err
 	}
+	// stop notifiers started by New. Connections are opened again when the instance is used by Import
+	defer r.Close()
+	defaultInstance = r
+	r.logTargets()
 	return nil
 }
 
@@ -93,43 +373,25 @@ func Run(configFile string, opt *Option) error {
 }
 
 func RunWithContext(ctx context.Context, configFile string, opt *Option) error {
-	var err error
 	log.Println("[info] Loading config:", configFile)
-	config, err = LoadConfig(ctx, configFile)
+	config, err := LoadConfig(ctx, configFile)
 	if err != nil {
 		return err
 	}
-	for _, target := range config.Targets {
-		log.Println("[info] Define target", target.String())
-	}
-
-	if Sessions.SQS == nil {
-		opts := []func(*awsConfig.LoadOptions) error{
-			awsConfig.WithRegion(config.Credentials.AWS_REGION),
-		}
-		if config.Credentials.AWS_ACCESS_KEY_ID != "" {
-			opts = append(opts, awsConfig.WithCredentialsProvider(credentials.StaticCredentialsProvider{
-				Value: aws.Credentials{
-					AccessKeyID:     config.Credentials.AWS_ACCESS_KEY_ID,
-					SecretAccessKey: config.Credentials.AWS_SECRET_ACCESS_KEY,
-					Source:          "from Rin config",
-				},
-			}))
-		}
-		c, err := awsConfig.LoadDefaultConfig(ctx, opts...)
-		if err != nil {
-			return err
-		}
-		Sessions.SQS = &c
-		Sessions.SQSOptFns = make([]func(*sqs.Options), 0)
-		Sessions.Redshift = &c
-		Sessions.RedshiftOptFns = make([]func(*redshift.Options), 0)
-		Sessions.S3 = &c
-		Sessions.S3OptFns = make([]func(*s3.Options), 0)
+	r, err := New(config,
+		WithSessions(Sessions),
+		WithOption(opt),
+		WithMaxDeleteRetry(MaxDeleteRetry),
+	)
+	if err != nil {
+		return err
 	}
+	defer r.Close()
+	defaultInstance = r
+	r.logTargets()
 
 	if isLambda() {
-		return runLambdaHandler(opt)
+		return r.Run(ctx)
 	}
 
 	signalCh := make(chan os.Signal, 1)
@@ -137,7 +399,7 @@ func RunWithContext(ctx context.Context, configFile string, opt *Option) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	var wg sync.WaitGroup
-	wg.Add(2) // signal handler + sqsWorker
+	wg.Add(1) // signal handler
 
 	// wait for signal
 	go func() {
@@ -151,15 +413,37 @@ func RunWithContext(ctx context.Context, configFile string, opt *Option) error {
 		}
 	}()
 
-	// run worker
-	err = sqsWorker(ctx, &wg, opt)
-	if e, ok := err.(MaxExecutionTimeReachedError); ok {
-		log.Printf("[info] %s", e.Error())
-		cancel()
-	}
+	err = r.Run(ctx)
+	cancel()
 
 	wg.Wait()
 	log.Println("[info] Shutdown.")
+	return err
+}
+
+// Import imports the event by the instance started by Run, and returns the number of processed records.
+func Import(ctx context.Context, event Event) (int, error) {
+	results, err := defaultInstance.Import(ctx, event)
+	return results.Processed(), err
+}
+
+// Run runs SQS workers until the context is canceled. On AWS Lambda, it starts a Lambda handler.
+func (r *Rin) Run(ctx context.Context) error {
+	if isLambda() {
+		return r.runLambdaHandler()
+	}
+	if r.config.Admin != nil {
+		stop, err := r.startAdmin()
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	err := r.runWorkers(ctx)
+	if e, ok := err.(MaxExecutionTimeReachedError); ok {
+		r.logger.Printf("[info] %s", e.Error())
+		return nil
+	}
 	if ctx.Err() == context.Canceled {
 		// normally exit
 		return nil
@@ -167,47 +451,121 @@ func RunWithContext(ctx context.Context, configFile string, opt *Option) error {
 	return err
 }
 
+// runWorkers runs SQS workers for all queues and waits for them.
+// When a worker returns an error, all other workers are stopped.
+func (r *Rin) runWorkers(ctx context.Context) error {
+	if r.option.Local != "" {
+		return r.runLocal(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var err error
+	for _, q := range r.config.Queues {
+		for i := 0; i < q.Workers; i++ {
+			wg.Add(1)
+			go func(q *Queue) {
+				if e := r.sqsWorker(ctx, &wg, q); e != nil {
+					once.Do(func() {
+						err = e
+						cancel()
+					})
+				}
+			}(q)
+		}
+	}
+	wg.Wait()
+	return err
+}
+
 func isLambda() bool {
 	return strings.HasPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_Lambda") || os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
 }
 
-func sqsWorker(ctx context.Context, wg *sync.WaitGroup, opt *Option) error {
-	svc := sqs.NewFromConfig(*Sessions.SQS, Sessions.SQSOptFns...)
+func (r *Rin) sqsWorker(ctx context.Context, wg *sync.WaitGroup, q *Queue) error {
+	defer wg.Done()
+	mq, err := r.newSQSQueue(ctx, q)
+	if err != nil {
+		return err
+	}
+	return r.worker(ctx, q, mq, "SQS")
+}
+
+// runLocal runs a worker which reads events from the local path, and returns when all events have been read.
+// Events are imported into the targets of Option.LocalQueue, or the targets of the configuration.
+func (r *Rin) runLocal(ctx context.Context) error {
+	lq, err := NewLocalQueue(r.option.Local)
+	if err != nil {
+		return err
+	}
+	targets := r.config.Targets
+	if name := r.option.LocalQueue; name != "" {
+		q := r.config.QueueByName(name)
+		if q == nil {
+			return fmt.Errorf("queue %s is not defined", name)
+		}
+		targets = q.targets
+	}
+	q := &Queue{Name: r.option.Local, Workers: 1, BatchSize: 1, targets: targets}
+	err = r.worker(ctx, q, lq, "local")
+	acked, nacked := lq.Acked(), lq.Nacked()
+	r.logger.Printf("[info] %d messages were acked and %d messages were nacked from %s", len(acked), len(nacked), r.option.Local)
+	for _, msg := range nacked {
+		r.logger.Printf("[warn] [%s] Nacked message", msg.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if len(nacked) > 0 {
+		return fmt.Errorf("%d messages were failed", len(nacked))
+	}
+	return nil
+}
+
+func (r *Rin) worker(ctx context.Context, q *Queue, mq MessageQueue, kind string) error {
 	var mode string
-	if opt.BatchMode {
+	if r.option.BatchMode {
 		mode = "Batch"
 	} else {
 		mode = "Worker"
 	}
-	log.Printf("[info] Starting up SQS %s", mode)
-	defer log.Printf("[info] Shutdown SQS %s", mode)
-	defer wg.Done()
+	r.logger.Printf("[info] Starting up %s %s for %s", kind, mode, q.Name)
+	defer r.logger.Printf("[info] Shutdown %s %s for %s", kind, mode, q.Name)
 
-	log.Println("[info] Connect to SQS:", config.QueueName)
-	res, err := svc.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
-		QueueName: aws.String(config.QueueName),
-	})
-	if err != nil {
-		return err
-	}
 	var timeout <-chan time.Time
-	if opt.MaxExecutionTime > 0 {
-		timeout = time.NewTimer(opt.MaxExecutionTime).C
+	if r.option.MaxExecutionTime > 0 {
+		timeout = time.NewTimer(r.option.MaxExecutionTime).C
 	} else {
 		timeout = make(chan time.Time, 1) // never timeout
 	}
+	var inflight *inFlight
+	if q.MaxInFlight > 0 {
+		inflight = &inFlight{sem: make(chan struct{}, q.MaxInFlight)}
+		defer inflight.wait()
+	}
+	// local queues are not waited for new messages
+	_, local := mq.(*LocalQueue)
 	for {
 		select {
 		case <-timeout:
 			return MaxExecutionTimeReachedError{}
 		case <-ctx.Done():
 			return nil
+		case <-r.state.drain:
+			r.logger.Printf("[info] Drained %s %s for %s", kind, mode, q.Name)
+			return nil
 		default:
 		}
-		if err := handleMessage(ctx, svc, res.QueueUrl); err != nil {
+		if !r.state.wait(ctx) {
+			// drained or canceled while paused
+			continue
+		}
+		if err := r.handleMessage(ctx, mq, q, inflight); err != nil {
 			if e, ok := err.(NoMessageError); ok {
-				if opt.BatchMode {
-					log.Printf("[info] %s. Exit.", e.Error())
+				if r.option.BatchMode || local {
+					r.logger.Printf("[info] %s. Exit.", e.Error())
 					break
 				}
 				time.Sleep(100 * time.Millisecond)
@@ -217,85 +575,212 @@ func sqsWorker(ctx context.Context, wg *sync.WaitGroup, opt *Option) error {
 	return nil
 }
 
-func handleMessage(ctx context.Context, svc *sqs.Client, queueUrl *string) error {
-	var completed = false
-	res, err := svc.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
-		MaxNumberOfMessages: 1,
-		QueueUrl:            queueUrl,
-	})
+// inFlight limits the number of messages processed in the background by a worker.
+type inFlight struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+// start runs fn in the background. It blocks while the number of in-flight messages reaches the limit.
+func (f *inFlight) start(ctx context.Context, fn func()) error {
+	select {
+	case f.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	f.wg.Add(1)
+	go func() {
+		defer func() {
+			<-f.sem
+			f.wg.Done()
+		}()
+		fn()
+	}()
+	return nil
+}
+
+func (f *inFlight) wait() {
+	f.wg.Wait()
+}
+
+// handleMessage receives messages and processes them. When inflight is not nil, messages are processed in the background and the worker continues to receive.
+func (r *Rin) handleMessage(ctx context.Context, mq MessageQueue, q *Queue, inflight *inFlight) error {
+	msgs, err := mq.Receive(ctx)
 	if err != nil {
 		return err
 	}
-	if len(res.Messages) == 0 {
-		return NoMessageError{"No messages"}
+	if q.IsFIFO() {
+		if inflight != nil {
+			// messages in the same group are not delivered while they are in flight
+			return inflight.start(ctx, func() {
+				r.handleFIFOMessages(ctx, mq, q, msgs)
+			})
+		}
+		return r.handleFIFOMessages(ctx, mq, q, msgs)
+	}
+	for _, msg := range msgs {
+		if inflight != nil {
+			msg := msg
+			if e := inflight.start(ctx, func() {
+				r.processMessage(ctx, mq, q, msg)
+			}); e != nil {
+				return e
+			}
+			continue
+		}
+		// a failed message will be visible again after the visibility timeout
+		if e := r.processMessage(ctx, mq, q, msg); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// handleFIFOMessages processes messages in each message group strictly in order, and different groups in parallel.
+// When a message is aborted, the following messages in the same group are not processed.
+func (r *Rin) handleFIFOMessages(ctx context.Context, mq MessageQueue, q *Queue, msgs []*Message) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var err error
+	for _, group := range groupMessages(msgs) {
+		wg.Add(1)
+		go func(group []*Message) {
+			defer wg.Done()
+			for i, msg := range group {
+				e := ctx.Err()
+				if e == nil {
+					e = r.processMessage(ctx, mq, q, msg)
+				}
+				if e != nil {
+					if rest := len(group) - i - 1; rest > 0 {
+						r.logger.Printf("[warn] [%s] Skipped %d following messages in group %s", msg.ID, rest, msg.GroupID)
+					}
+					mu.Lock()
+					err = e
+					mu.Unlock()
+					return
+				}
+			}
+		}(group)
+	}
+	wg.Wait()
+	return err
+}
+
+// groupMessages groups messages by MessageGroupId with keeping the received order.
+func groupMessages(msgs []*Message) [][]*Message {
+	var groups [][]*Message
+	index := make(map[string]int)
+	for _, msg := range msgs {
+		if i, ok := index[msg.GroupID]; ok {
+			groups[i] = append(groups[i], msg)
+		} else {
+			index[msg.GroupID] = len(groups)
+			groups = append(groups, []*Message{msg})
+		}
 	}
-	msg := res.Messages[0]
-	msgId := *msg.MessageId
-	log.Printf("[info] [%s] Starting process message.", msgId)
-	log.Printf("[debug] [%s] handle: %s", msgId, *msg.ReceiptHandle)
-	log.Printf("[debug] [%s] body: %s", msgId, *msg.Body)
+	return groups
+}
+
+func (r *Rin) processMessage(ctx context.Context, mq MessageQueue, q *Queue, msg *Message) error {
+	var completed = false
+	msgId := msg.ID
+	r.logger.Printf("[info] [%s] Starting process message.", msgId)
+	r.state.start(msgId, q.Name)
+	defer r.state.done(msgId)
+	r.logger.Printf("[debug] [%s] handle: %s", msgId, msg.ReceiptHandle)
+	r.logger.Printf("[debug] [%s] body: %s", msgId, msg.Body)
 
 	defer func() {
 		if !completed {
-			log.Printf("[info] [%s] Aborted message. ReceiptHandle: %s", msgId, *msg.ReceiptHandle)
+			r.logger.Printf("[info] [%s] Aborted message. ReceiptHandle: %s", msgId, msg.ReceiptHandle)
 		}
 	}()
 
-	if err := processEvent(ctx, msgId, *msg.Body); err != nil {
+	if err := r.processEvent(ctx, q.targets, msgId, msg.Body, q.isFinalAttempt(msg.ReceiveCount)); err != nil {
+		if e, ok := err.(*DeferredError); ok {
+			if d, ok := mq.(Deferrer); ok {
+				if de := d.Defer(ctx, msg, time.Until(e.Until)); de != nil {
+					r.logger.Printf("[warn] [%s] Can't defer message. It will be delivered again after the visibility timeout. %s", msgId, de)
+				} else {
+					completed = true
+					r.logger.Printf("[info] [%s] Deferred message until %s.", msgId, e.Until.Format(time.RFC3339))
+				}
+				return err
+			}
+		}
+		if e := mq.Nack(ctx, msg); e != nil {
+			r.logger.Printf("[warn] [%s] Can't nack message. %s", msgId, e)
+		}
 		return err
 	}
 
 	ctxDelete, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err = svc.DeleteMessage(ctxDelete, &sqs.DeleteMessageInput{
-		QueueUrl:      queueUrl,
-		ReceiptHandle: msg.ReceiptHandle,
-	})
+	err := mq.Ack(ctxDelete, msg)
 	if err != nil {
-		log.Printf("[warn] [%s] Can't delete message. %s", msgId, err)
+		r.logger.Printf("[warn] [%s] Can't delete message. %s", msgId, err)
 		// retry
-		for i := 1; i <= MaxDeleteRetry; i++ {
-			log.Printf("[info] [%s] Retry to delete after %d sec.", msgId, i*i)
+		for i := 1; i <= r.maxDeleteRetry; i++ {
+			r.logger.Printf("[info] [%s] Retry to delete after %d sec.", msgId, i*i)
 			time.Sleep(time.Duration(i*i) * time.Second)
-			_, err = svc.DeleteMessage(context.Background(), &sqs.DeleteMessageInput{
-				QueueUrl:      queueUrl,
-				ReceiptHandle: msg.ReceiptHandle,
-			})
+			err = mq.Ack(context.Background(), msg)
 			if err == nil {
-				log.Printf("[info] [%s] Message was deleted successfuly.", msgId)
+				r.logger.Printf("[info] [%s] Message was deleted successfuly.", msgId)
 				break
 			}
-			log.Printf("[warn] [%s] Can't delete message. %s", msgId, err)
-			if i == MaxDeleteRetry {
-				log.Printf("[error] [%s] Max retry count reached. Giving up.", msgId)
+			r.logger.Printf("[warn] [%s] Can't delete message. %s", msgId, err)
+			if i == r.maxDeleteRetry {
+				r.logger.Printf("[error] [%s] Max retry count reached. Giving up.", msgId)
 			}
 		}
 	}
 
 	completed = true
-	log.Printf("[info] [%s] Completed message.", msgId)
+	r.logger.Printf("[info] [%s] Completed message.", msgId)
 	return nil
 }
 
-func processEvent(ctx context.Context, msgId string, body string) error {
+// ProcessMessage imports the event in the body of a message into the targets of the configuration.
+// on_failure actions don't run, because the attempts of the message are unknown.
+func (r *Rin) ProcessMessage(ctx context.Context, msgId string, body string) error {
+	return r.processEvent(ctx, r.config.Targets, msgId, body, false)
+}
+
+func (r *Rin) processEvent(ctx context.Context, targets []*Target, msgId string, body string, final bool) error {
+	start := time.Now()
 	event, err := ParseEvent([]byte(body))
 	if err != nil {
-		log.Printf("[error] [%s] Can't parse event from Body. %s", msgId, err)
+		r.logger.Printf("[error] [%s] Can't parse event from Body. %s", msgId, err)
+		r.notify(&Notification{Event: NotifyPoison, MessageID: msgId, Error: err.Error()})
 		return err
 	}
 	if event.IsTestEvent() {
-		log.Printf("[info] [%s] Skipping %s", msgId, event.String())
+		r.logger.Printf("[info] [%s] Skipping %s", msgId, event.String())
 	} else {
-		log.Printf("[info] [%s] Importing event: %s", msgId, event)
-		n, err := Import(ctx, event)
+		r.logger.Printf("[info] [%s] Importing event: %s", msgId, event)
+		results, err := r.importTargets(ctx, event, targets, msgId, final)
+		n := results.Processed()
+		if e, ok := err.(*DeferredError); ok {
+			r.logger.Printf("[info] [%s] Deferred. %s", msgId, e)
+			return err
+		}
 		if err != nil {
-			log.Printf("[error] [%s] Import failed. %s", msgId, err)
+			r.logger.Printf("[error] [%s] Import failed. %s", msgId, err)
+			if ctx.Err() == nil {
+				m := &Notification{Event: NotifyFailure, MessageID: msgId, Error: err.Error(), Processed: n, Rows: results.Rows(), Duration: time.Since(start).Seconds()}
+				if e, ok := err.(*ImportError); ok {
+					m.Target, m.Table, m.Record = e.Target.String(), e.Table, e.Record.String()
+				}
+				r.notify(m)
+			}
 			return err
 		}
 		if n == 0 {
-			log.Printf("[warn] [%s] All events were not matched for any targets. Ignored.", msgId)
+			r.logger.Printf("[warn] [%s] All events were not matched for any targets. Ignored.", msgId)
 		} else {
-			log.Printf("[info] [%s] %d actions completed.", msgId, n)
+			r.logger.Printf("[info] [%s] %d actions completed.", msgId, n)
+			r.notify(&Notification{Event: NotifySuccess, MessageID: msgId, Processed: n, Rows: results.Rows(), Duration: time.Since(start).Seconds()})
 		}
 	}
 	return nil
@@ -0,0 +1,58 @@
+package rin_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestInstances(t *testing.T) {
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "SSS")
+	var buf1, buf2 bytes.Buffer
+	r1 := newTestInstance(t, "test/config.yml", rin.WithLogger(log.New(&buf1, "", 0)))
+	r2 := newTestInstance(t, "test/config.queues.yml", rin.WithLogger(log.New(&buf2, "", 0)))
+
+	if r1.Config() == r2.Config() {
+		t.Error("instances must not share the config")
+	}
+
+	event, err := rin.ParseEvent([]byte(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"test/foo/discard/xxx.json","size":10}}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := r1.Import(context.Background(), event)
+	if err != nil {
+		t.Error(err)
+	}
+	if n := results.Processed(); n != 1 || results[0].Outcome != rin.OutcomeDiscarded {
+		t.Errorf("unexpected processed count %d", n)
+	}
+
+	// config.queues.yml has no targets for the key
+	results, err = r2.Import(context.Background(), event)
+	if err != nil {
+		t.Error(err)
+	}
+	if n := len(results); n != 0 {
+		t.Errorf("unexpected processed count %d", n)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "SSS")
+	if err := rin.DryRun("test/config.yml", &rin.Option{}); err != nil {
+		t.Fatal(err)
+	}
+	// the instance created by DryRun imports events as the one created by Run
+	event, err := rin.ParseEvent([]byte(`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"test/foo/discard/xxx.json","size":10}}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rin.Import(context.Background(), event); err != nil || n != 1 {
+		t.Errorf("unexpected import %d %v", n, err)
+	}
+}
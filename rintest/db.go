@@ -0,0 +1,198 @@
+package rintest
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DB is a SQL driver which records statements instead of executing them.
+// It implements driver.Connector to be used by rin.WithConnector.
+// Transactions are recorded as BEGIN, COMMIT and ROLLBACK.
+type DB struct {
+	// CopyCount is the value of pg_last_copy_count(). The default is 1.
+	CopyCount int64
+
+	mu         sync.Mutex
+	statements []string
+	failures   []*failure
+	results    []*result
+}
+
+type failure struct {
+	substr string
+	n      int
+	err    error
+}
+
+type result struct {
+	substr  string
+	columns []string
+	values  [][]driver.Value
+}
+
+// NewDB creates a recording SQL driver.
+func NewDB() *DB {
+	return &DB{CopyCount: 1}
+}
+
+// Statements returns the recorded statements in order.
+func (d *DB) Statements() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.statements...)
+}
+
+// Reset clears the recorded statements.
+func (d *DB) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.statements = nil
+}
+
+// Fail makes the next n statements which contain substr fail with err. The failed statements are recorded too.
+func (d *DB) Fail(substr string, n int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures = append(d.failures, &failure{substr: substr, n: n, err: err})
+}
+
+// SetRows sets rows returned by queries which contain substr. Queries without rows return no rows.
+func (d *DB) SetRows(substr string, columns []string, values ...[]driver.Value) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.results = append(d.results, &result{substr: substr, columns: columns, values: values})
+}
+
+// Connect implements driver.Connector.
+func (d *DB) Connect(ctx context.Context) (driver.Conn, error) {
+	return &conn{db: d}, nil
+}
+
+// Driver implements driver.Connector.
+func (d *DB) Driver() driver.Driver {
+	return d
+}
+
+// Open implements driver.Driver. The name is ignored.
+func (d *DB) Open(name string) (driver.Conn, error) {
+	return &conn{db: d}, nil
+}
+
+func (d *DB) record(query string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.statements = append(d.statements, query)
+	for _, f := range d.failures {
+		if f.n > 0 && strings.Contains(query, f.substr) {
+			f.n--
+			return f.err
+		}
+	}
+	return nil
+}
+
+func (d *DB) query(query string) (driver.Rows, error) {
+	if err := d.record(query); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.results {
+		if strings.Contains(query, r.substr) {
+			return &rows{columns: r.columns, values: r.values}, nil
+		}
+	}
+	if strings.Contains(query, "pg_last_copy_count()") {
+		return &rows{columns: []string{"pg_last_copy_count"}, values: [][]driver.Value{{d.CopyCount}}}, nil
+	}
+	return &rows{}, nil
+}
+
+type conn struct {
+	db *DB
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	if err := c.db.record("BEGIN"); err != nil {
+		return nil, err
+	}
+	return &tx{conn: c}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.db.record(query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.db.query(query)
+}
+
+type tx struct {
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	return t.conn.db.record("COMMIT")
+}
+
+func (t *tx) Rollback() error {
+	return t.conn.db.record("ROLLBACK")
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, nil)
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.db.query(s.query)
+}
+
+type rows struct {
+	columns []string
+	values  [][]driver.Value
+	i       int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.i >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.i])
+	r.i++
+	return nil
+}
@@ -0,0 +1,47 @@
+// Package rintest provides in-memory fakes of SQS, S3 and Redshift to test Rin without AWS.
+//
+// SQS and S3 are served over HTTP by httptest servers, and Sessions returns a SessionStore which sends requests to them.
+// DB is a SQL driver which records statements, and it is used by rin.WithConnector.
+package rintest
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+// Region is the region of the sessions returned by Sessions.
+const Region = "ap-northeast-1"
+
+// Sessions returns a SessionStore which sends requests to the fakes. A nil fake is not used.
+func Sessions(q *SQS, s *S3) *rin.SessionStore {
+	cfg := &aws.Config{
+		Region:      Region,
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	store := &rin.SessionStore{SQS: cfg, Redshift: cfg, S3: cfg}
+	if q != nil {
+		store.SQSOptFns = []func(*sqs.Options){func(o *sqs.Options) {
+			o.EndpointResolver = sqs.EndpointResolverFunc(func(region string, _ sqs.EndpointResolverOptions) (aws.Endpoint, error) {
+				return endpoint(q.URL(), region), nil
+			})
+		}}
+	}
+	if s != nil {
+		store.S3OptFns = []func(*s3.Options){func(o *s3.Options) {
+			o.EndpointResolver = s3.EndpointResolverFunc(func(region string, _ s3.EndpointResolverOptions) (aws.Endpoint, error) {
+				return endpoint(s.URL(), region), nil
+			})
+			o.UsePathStyle = true
+		}}
+	}
+	return store
+}
+
+// endpoint returns a new endpoint for each request, because resolvers may be called concurrently.
+func endpoint(url, region string) aws.Endpoint {
+	return aws.Endpoint{URL: url, SigningRegion: region, Source: aws.EndpointSourceCustom}
+}
@@ -0,0 +1,227 @@
+package rintest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Object is an object stored in the in-memory S3.
+type Object struct {
+	Body     []byte
+	Metadata map[string]string
+	Tags     map[string]string
+}
+
+func (o *Object) etag() string {
+	h := md5.Sum(o.Body)
+	return `"` + hex.EncodeToString(h[:]) + `"`
+}
+
+// S3 is an in-memory S3 served by path-style requests.
+// It supports GetObject with a range, HeadObject, PutObject, CopyObject, DeleteObject and tagging of objects.
+type S3 struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string]*Object // by bucket/key
+	requests []string
+}
+
+// NewS3 starts an in-memory S3. It must be closed by Close.
+func NewS3() *S3 {
+	s := &S3{objects: make(map[string]*Object)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL returns the endpoint of the server.
+func (s *S3) URL() string {
+	return s.server.URL
+}
+
+// Close shuts down the server.
+func (s *S3) Close() {
+	s.server.Close()
+}
+
+// Put stores the object.
+func (s *S3) Put(bucket, key string, obj *Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+key] = obj
+}
+
+// Get returns the object.
+func (s *S3) Get(bucket, key string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[bucket+"/"+key]
+	return obj, ok
+}
+
+// Keys returns sorted keys of objects in the bucket.
+func (s *S3) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for path := range s.objects {
+		if strings.HasPrefix(path, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(path, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Requests returns the requests to the server in order, as "METHOD /bucket/key" with "?tagging" for tagging.
+func (s *S3) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Tags    []s3Tag  `xml:"TagSet>Tag"`
+}
+
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+func (s *S3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	_, tagging := r.URL.Query()["tagging"]
+	req := r.Method + " /" + path
+	if tagging {
+		req += "?tagging"
+	}
+	s.requests = append(s.requests, req)
+	if !strings.Contains(path, "/") {
+		// operations for buckets
+		if r.Method == http.MethodPut {
+			return
+		}
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "operations for buckets are not implemented")
+		return
+	}
+	obj := s.objects[path]
+
+	switch r.Method {
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			from := s.objects[strings.TrimPrefix(src, "/")]
+			if from == nil {
+				writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+				return
+			}
+			copied := *from
+			s.objects[path] = &copied
+			fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, copied.etag())
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if tagging {
+			if obj == nil {
+				writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+				return
+			}
+			var t s3Tagging
+			if err := xml.Unmarshal(body, &t); err != nil {
+				writeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+				return
+			}
+			obj.Tags = make(map[string]string, len(t.Tags))
+			for _, tag := range t.Tags {
+				obj.Tags[tag.Key] = tag.Value
+			}
+			return
+		}
+		obj = &Object{Body: body, Metadata: map[string]string{}}
+		for name := range r.Header {
+			if lname := strings.ToLower(name); strings.HasPrefix(lname, "x-amz-meta-") {
+				obj.Metadata[strings.TrimPrefix(lname, "x-amz-meta-")] = r.Header.Get(name)
+			}
+		}
+		s.objects[path] = obj
+		w.Header().Set("ETag", obj.etag())
+	case http.MethodDelete:
+		delete(s.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		if obj == nil {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if tagging {
+			var t s3Tagging
+			for _, k := range sortedKeys(obj.Tags) {
+				t.Tags = append(t.Tags, s3Tag{Key: k, Value: obj.Tags[k]})
+			}
+			xml.NewEncoder(w).Encode(&t)
+			return
+		}
+		for k, v := range obj.Metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		w.Header().Set("ETag", obj.etag())
+		body, status := obj.Body, http.StatusOK
+		var start, end int
+		if rng := r.Header.Get("Range"); rng != "" {
+			if n, _ := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); n > 0 && start < len(body) {
+				if n == 1 || end >= len(body) {
+					end = len(body) - 1
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+				body, status = body[start:end+1], http.StatusPartialContent
+			}
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed.")
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(&struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,369 @@
+package rintest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SQS is an in-memory SQS served by the query protocol.
+// Received messages are invisible for VisibilityTimeout, and they are delivered again unless they are deleted.
+// Messages sent by SendToGroup are delivered in order as FIFO queues do. While a message of a group is invisible, the following messages of the group are not delivered.
+type SQS struct {
+	// VisibilityTimeout is the duration in which received messages are invisible. The default is zero, so failed messages are delivered again immediately.
+	VisibilityTimeout time.Duration
+
+	server *httptest.Server
+
+	mu           sync.Mutex
+	queues       map[string]*fakeQueue
+	requests     []string
+	seq          int
+	deleteErrors int
+}
+
+type fakeQueue struct {
+	messages []*fakeMessage
+	deleted  []string
+}
+
+type fakeMessage struct {
+	id        string
+	body      string
+	groupID   string
+	receipt   string
+	receives  int
+	visibleAt time.Time
+	deleted   bool
+}
+
+// NewSQS starts an in-memory SQS. It must be closed by Close.
+func NewSQS() *SQS {
+	s := &SQS{queues: make(map[string]*fakeQueue)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL returns the endpoint of the server.
+func (s *SQS) URL() string {
+	return s.server.URL
+}
+
+// Close shuts down the server.
+func (s *SQS) Close() {
+	s.server.Close()
+}
+
+// CreateQueue creates a queue if it does not exist.
+func (s *SQS) CreateQueue(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue(name)
+}
+
+// Send sends a message to the queue, and returns the message id. The queue is created if it does not exist.
+func (s *SQS) Send(queue, body string) string {
+	return s.SendToGroup(queue, "", body)
+}
+
+// SendToGroup sends a message in the message group to the queue, and returns the message id.
+func (s *SQS) SendToGroup(queue, group, body string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send(s.queue(queue), group, body, 0)
+}
+
+// Messages returns the number of messages in the queue which have not been deleted.
+func (s *SQS) Messages(queue string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, m := range s.queue(queue).messages {
+		if !m.deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// Deleted returns ids of the messages deleted from the queue in order.
+func (s *SQS) Deleted(queue string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.queue(queue).deleted...)
+}
+
+// Receives returns how many times the message has been received.
+func (s *SQS) Receives(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues {
+		for _, m := range q.messages {
+			if m.id == id {
+				return m.receives
+			}
+		}
+	}
+	return 0
+}
+
+// VisibleAt returns the time when the message will be visible.
+func (s *SQS) VisibleAt(id string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues {
+		for _, m := range q.messages {
+			if m.id == id {
+				return m.visibleAt
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// Requests returns the actions requested to the server in order, as "Action queue".
+func (s *SQS) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// FailDelete makes the next n DeleteMessage requests fail.
+func (s *SQS) FailDelete(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteErrors = n
+}
+
+func (s *SQS) queue(name string) *fakeQueue {
+	q := s.queues[name]
+	if q == nil {
+		q = &fakeQueue{}
+		s.queues[name] = q
+	}
+	return q
+}
+
+func (s *SQS) send(q *fakeQueue, group, body string, delay time.Duration) string {
+	s.seq++
+	m := &fakeMessage{id: fmt.Sprintf("message-%d", s.seq), body: body, groupID: group, visibleAt: time.Now().Add(delay)}
+	q.messages = append(q.messages, m)
+	return m.id
+}
+
+type sqsResponse struct {
+	XMLName  xml.Name
+	Result   interface{} `xml:",omitempty"`
+	Metadata struct {
+		RequestID string `xml:"RequestId"`
+	} `xml:"ResponseMetadata"`
+}
+
+type sqsMessage struct {
+	MessageID     string         `xml:"MessageId"`
+	ReceiptHandle string         `xml:"ReceiptHandle"`
+	MD5OfBody     string         `xml:"MD5OfBody"`
+	Body          string         `xml:"Body"`
+	Attributes    []sqsAttribute `xml:"Attribute"`
+}
+
+type sqsAttribute struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+func (s *SQS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeSQSError(w, "InvalidParameterValue", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	action := r.Form.Get("Action")
+	if name := r.Form.Get("QueueName"); name != "" {
+		s.requests = append(s.requests, action+" "+name)
+	} else {
+		s.requests = append(s.requests, action+" "+path.Base(r.Form.Get("QueueUrl")))
+	}
+
+	var result interface{}
+	switch action {
+	case "CreateQueue", "GetQueueUrl":
+		name := r.Form.Get("QueueName")
+		if action == "CreateQueue" {
+			s.queue(name)
+		} else if s.queues[name] == nil {
+			writeSQSError(w, "AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist.")
+			return
+		}
+		result = &struct {
+			XMLName  xml.Name
+			QueueURL string `xml:"QueueUrl"`
+		}{XMLName: xml.Name{Local: action + "Result"}, QueueURL: s.server.URL + "/queue/" + name}
+	case "SendMessage":
+		q := s.queues[path.Base(r.Form.Get("QueueUrl"))]
+		if q == nil {
+			writeSQSError(w, "AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist.")
+			return
+		}
+		body := r.Form.Get("MessageBody")
+		delay, _ := strconv.Atoi(r.Form.Get("DelaySeconds"))
+		result = &struct {
+			XMLName          xml.Name `xml:"SendMessageResult"`
+			MessageID        string   `xml:"MessageId"`
+			MD5OfMessageBody string   `xml:"MD5OfMessageBody"`
+		}{MessageID: s.send(q, r.Form.Get("MessageGroupId"), body, time.Duration(delay)*time.Second), MD5OfMessageBody: md5Hex(body)}
+	case "ReceiveMessage":
+		q := s.queues[path.Base(r.Form.Get("QueueUrl"))]
+		if q == nil {
+			writeSQSError(w, "AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist.")
+			return
+		}
+		result = &struct {
+			XMLName  xml.Name     `xml:"ReceiveMessageResult"`
+			Messages []sqsMessage `xml:"Message"`
+		}{Messages: s.receive(q, r)}
+	case "DeleteMessage":
+		if s.deleteErrors > 0 {
+			s.deleteErrors--
+			writeSQSError(w, "ReceiptHandleIsInvalid", "The receipt handle is not valid.")
+			return
+		}
+		if !s.delete(r.Form.Get("ReceiptHandle")) {
+			writeSQSError(w, "ReceiptHandleIsInvalid", "The receipt handle is not valid.")
+			return
+		}
+	case "ChangeMessageVisibility":
+		m := s.message(r.Form.Get("ReceiptHandle"))
+		if m == nil {
+			writeSQSError(w, "ReceiptHandleIsInvalid", "The receipt handle is not valid.")
+			return
+		}
+		timeout, _ := strconv.Atoi(r.Form.Get("VisibilityTimeout"))
+		m.visibleAt = time.Now().Add(time.Duration(timeout) * time.Second)
+	default:
+		writeSQSError(w, "InvalidAction", "The action "+action+" is not valid for this endpoint.")
+		return
+	}
+	res := &sqsResponse{XMLName: xml.Name{Local: action + "Response"}, Result: result}
+	res.Metadata.RequestID = fmt.Sprintf("request-%d", len(s.requests))
+	w.Header().Set("Content-Type", "text/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func (s *SQS) receive(q *fakeQueue, r *http.Request) []sqsMessage {
+	max := 1
+	if n, err := strconv.Atoi(r.Form.Get("MaxNumberOfMessages")); err == nil && n > 0 {
+		max = n
+	}
+	attrs := make(map[string]bool)
+	for i := 1; r.Form.Has(fmt.Sprintf("AttributeName.%d", i)); i++ {
+		attrs[r.Form.Get(fmt.Sprintf("AttributeName.%d", i))] = true
+	}
+	return s.deliver(q, max, attrs)
+}
+
+// LambdaEvent receives up to max messages of the queue and returns them as an event of Lambda with all attributes.
+func (s *SQS) LambdaEvent(queue string, max int) *events.SQSEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event := &events.SQSEvent{}
+	for _, m := range s.deliver(s.queue(queue), max, map[string]bool{"All": true}) {
+		attrs := make(map[string]string, len(m.Attributes))
+		for _, a := range m.Attributes {
+			attrs[a.Name] = a.Value
+		}
+		event.Records = append(event.Records, events.SQSMessage{
+			MessageId:      m.MessageID,
+			ReceiptHandle:  m.ReceiptHandle,
+			Body:           m.Body,
+			Attributes:     attrs,
+			EventSourceARN: "arn:aws:sqs:ap-northeast-1:123456789012:" + queue,
+		})
+	}
+	return event
+}
+
+func (s *SQS) deliver(q *fakeQueue, max int, attrs map[string]bool) []sqsMessage {
+	now := time.Now()
+	var msgs []sqsMessage
+	// messages in a group are delivered in order, so a group is blocked while its earlier message is in flight
+	blocked := make(map[string]bool)
+	for _, m := range q.messages {
+		if len(msgs) >= max {
+			break
+		}
+		if m.deleted || blocked[m.groupID] {
+			continue
+		}
+		if now.Before(m.visibleAt) {
+			if m.groupID != "" {
+				blocked[m.groupID] = true
+			}
+			continue
+		}
+		m.receives++
+		m.receipt = fmt.Sprintf("%s-receipt-%d", m.id, m.receives)
+		m.visibleAt = now.Add(s.VisibilityTimeout)
+		msg := sqsMessage{MessageID: m.id, ReceiptHandle: m.receipt, MD5OfBody: md5Hex(m.body), Body: m.body}
+		if (attrs["MessageGroupId"] || attrs["All"]) && m.groupID != "" {
+			msg.Attributes = append(msg.Attributes, sqsAttribute{Name: "MessageGroupId", Value: m.groupID})
+		}
+		if attrs["ApproximateReceiveCount"] || attrs["All"] {
+			msg.Attributes = append(msg.Attributes, sqsAttribute{Name: "ApproximateReceiveCount", Value: strconv.Itoa(m.receives)})
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func (s *SQS) delete(receipt string) bool {
+	for _, q := range s.queues {
+		for _, m := range q.messages {
+			if m.receipt == receipt && !m.deleted {
+				m.deleted = true
+				q.deleted = append(q.deleted, m.id)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *SQS) message(receipt string) *fakeMessage {
+	for _, q := range s.queues {
+		for _, m := range q.messages {
+			if m.receipt == receipt && !m.deleted {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+type sqsError struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Type    string   `xml:"Error>Type"`
+	Code    string   `xml:"Error>Code"`
+	Message string   `xml:"Error>Message"`
+}
+
+func writeSQSError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	xml.NewEncoder(w).Encode(&sqsError{Type: "Sender", Code: code, Message: message})
+}
+
+func md5Hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,140 @@
+package rin_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+	"github.com/fujiwara/Rin/rintest"
+)
+
+func TestHarnessRouting(t *testing.T) {
+	h := newHarness(t, "test/config.rintest.yml")
+	h.sqs.Send("rin_logs", s3Event("logs/access/1.json"))
+	h.sqs.Send("rin_logs", s3Event("logs/error/1.json"))
+	h.sqs.Send("rin_logs", s3Event("logs/unknown/1.json"))
+	h.sqs.Send("rin_events", s3Event("events/1.json"))
+	h.s3.Put("test.bucket.test", "events/1.json", &rintest.Object{Body: []byte(`{"id":1}`)})
+	h.run(t)
+
+	copies := h.copies()
+	if len(copies) != 3 {
+		t.Fatalf("unexpected statements %v", h.db.Statements())
+	}
+	for _, table := range []string{`"access_log"`, `"error_log"`, `"events"`} {
+		var found bool
+		for _, c := range copies {
+			if strings.Contains(c, "COPY "+table+" FROM") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("COPY into %s is not found in %v", table, copies)
+		}
+	}
+	for _, q := range []string{"rin_logs", "rin_events"} {
+		if n := h.sqs.Messages(q); n != 0 {
+			t.Errorf("%d messages are left in %s", n, q)
+		}
+	}
+	if keys := h.s3.Keys("test.bucket.test"); len(keys) != 0 {
+		t.Errorf("the imported object must be deleted %v", keys)
+	}
+	if _, ok := h.s3.Get("archive.bucket.test", "events/1.json"); !ok {
+		t.Errorf("the imported object must be copied %v", h.s3.Requests())
+	}
+}
+
+func TestHarnessRetry(t *testing.T) {
+	h := newHarness(t, "test/config.rintest.yml")
+	h.db.Fail("COPY", 1, errors.New("connection reset"))
+	id := h.sqs.Send("rin_logs", s3Event("logs/access/1.json"))
+	h.run(t)
+
+	if n := h.sqs.Receives(id); n != 2 {
+		t.Errorf("the failed message must be received again. received %d times", n)
+	}
+	if d := h.sqs.Deleted("rin_logs"); len(d) != 1 || d[0] != id {
+		t.Errorf("unexpected deleted messages %v", d)
+	}
+	var txs []string
+	for _, s := range h.db.Statements() {
+		if s == "BEGIN" || s == "COMMIT" || s == "ROLLBACK" {
+			txs = append(txs, s)
+		}
+	}
+	if expected := "BEGIN ROLLBACK BEGIN COMMIT"; strings.Join(txs, " ") != expected {
+		t.Errorf("unexpected transactions %v expected %s", txs, expected)
+	}
+}
+
+func TestHarnessNonEmpty(t *testing.T) {
+	h := newHarness(t, "test/config.rintest.yml")
+	h.sqs.VisibilityTimeout = time.Minute
+	h.db.CopyCount = 0
+	id := h.sqs.Send("rin_logs", s3Event("logs/orders/1.json"))
+	h.run(t)
+
+	if d := h.sqs.Deleted("rin_logs"); len(d) != 0 {
+		t.Errorf("the message must not be deleted %v", d)
+	}
+	if n := h.sqs.Receives(id); n != 1 {
+		t.Errorf("unexpected receives %d", n)
+	}
+	var stmts []string
+	for _, s := range h.db.Statements() {
+		if strings.HasPrefix(s, "/* Rin */ COPY") {
+			s = "COPY"
+		}
+		stmts = append(stmts, s)
+	}
+	// the empty load is rolled back
+	if expected := "BEGIN,COPY,SELECT pg_last_copy_count(),ROLLBACK"; strings.Join(stmts, ",") != expected {
+		t.Errorf("unexpected statements %v expected %s", stmts, expected)
+	}
+}
+
+func TestHarnessDeleteRetry(t *testing.T) {
+	h := newHarness(t, "test/config.rintest.yml", rin.WithMaxDeleteRetry(1))
+	h.sqs.FailDelete(1)
+	id := h.sqs.Send("rin_logs", s3Event("logs/access/1.json"))
+	h.run(t)
+
+	if n := h.sqs.Receives(id); n != 1 {
+		t.Errorf("the message must be received once. received %d times", n)
+	}
+	if d := h.sqs.Deleted("rin_logs"); len(d) != 1 {
+		t.Errorf("the message must be deleted by retry %v", h.sqs.Requests())
+	}
+	if n := len(h.copies()); n != 1 {
+		t.Errorf("the message must be imported once. imported %d times", n)
+	}
+}
+
+func TestHarnessBatch(t *testing.T) {
+	h := newHarness(t, "test/config.rintest.yml")
+	for i := 0; i < 3; i++ {
+		h.sqs.Send("rin_logs", s3Event(fmt.Sprintf("logs/access/%d.json", i)))
+	}
+	h.run(t)
+
+	var receives int
+	for _, req := range h.sqs.Requests() {
+		if req == "ReceiveMessage rin_logs" {
+			receives++
+		}
+	}
+	// a batch of 3 messages and an empty one
+	if receives != 2 {
+		t.Errorf("unexpected receives %d %v", receives, h.sqs.Requests())
+	}
+	if n := len(h.copies()); n != 3 {
+		t.Errorf("unexpected imports %d", n)
+	}
+	if d := h.sqs.Deleted("rin_logs"); len(d) != 3 {
+		t.Errorf("unexpected deleted messages %v", d)
+	}
+}
@@ -0,0 +1,201 @@
+package rin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DeferVisibility = "visibility"
+	DeferRequeue    = "requeue"
+
+	// MaxVisibilityTimeout and MaxDelay are the limits of SQS.
+	MaxVisibilityTimeout = 12 * time.Hour
+	MaxDelay             = 15 * time.Minute
+)
+
+// MaxLoadWindowSearch is the range to search the next time when a target can be loaded.
+var MaxLoadWindowSearch = 8 * 24 * time.Hour
+
+// Cron matches minutes by an expression of five fields, "minute hour day-of-month month day-of-week".
+// Fields accept *, numbers, ranges (a-b), steps (*/n, a-b/n) and lists (a,b). Sunday is 0 or 7.
+// The expression can be prefixed by "CRON_TZ={location}" or "TZ={location}". The default location is Local.
+type Cron struct {
+	expr             string
+	loc              *time.Location
+	minute, hour     uint64
+	dom, month, dow  uint64
+	domStar, dowStar bool
+}
+
+// ParseCron parses a cron expression.
+func ParseCron(expr string) (*Cron, error) {
+	c := &Cron{expr: expr, loc: time.Local}
+	fields := strings.Fields(expr)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=")) {
+		name := fields[0][strings.Index(fields[0], "=")+1:]
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone in %q, %w", expr, err)
+		}
+		c.loc, fields = loc, fields[1:]
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute in %q, %w", expr, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour in %q, %w", expr, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day of month in %q, %w", expr, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month in %q, %w", expr, err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day of week in %q, %w", expr, err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar, c.dowStar = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		from, to := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				// a/n means from a to the max
+				to = max
+			}
+			if from < min || to > max || from > to {
+				return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Match reports whether the minute of t is matched.
+func (c *Cron) Match(t time.Time) bool {
+	t = t.In(c.loc)
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	// both are restricted, either of them matches as cron does
+	return dom || dow
+}
+
+func (c *Cron) String() string {
+	return c.expr
+}
+
+func parseCrons(name string, exprs []string) ([]*Cron, error) {
+	crons := make([]*Cron, 0, len(exprs))
+	for _, expr := range exprs {
+		c, err := ParseCron(expr)
+		if err != nil {
+			return nil, fmt.Errorf("target.%s: %w", name, err)
+		}
+		crons = append(crons, c)
+	}
+	return crons, nil
+}
+
+func matchAny(crons []*Cron, t time.Time) bool {
+	for _, c := range crons {
+		if c.Match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Loadable reports whether the target can be loaded at t. It is matched by schedule if defined, and not matched by blackout.
+func (t *Target) Loadable(at time.Time) bool {
+	if len(t.schedule) > 0 && !matchAny(t.schedule, at) {
+		return false
+	}
+	return !matchAny(t.blackout, at)
+}
+
+// NextLoadTime returns at if the target can be loaded at at. Otherwise, it returns the start of the next minute when the target can be loaded.
+// When no such minute is found in MaxLoadWindowSearch, it returns at + MaxLoadWindowSearch.
+func (t *Target) NextLoadTime(at time.Time) time.Time {
+	if t.Loadable(at) {
+		return at
+	}
+	m := at.Truncate(time.Minute)
+	for end := at.Add(MaxLoadWindowSearch); m.Before(end); {
+		m = m.Add(time.Minute)
+		if t.Loadable(m) {
+			return m
+		}
+	}
+	return at.Add(MaxLoadWindowSearch)
+}
+
+// DeferredError is returned when a record matches a target out of its load window.
+// The message is not failed, and delivered again when the window opens.
+type DeferredError struct {
+	Target *Target
+	Until  time.Time
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("target %s is out of the load window until %s", e.Target, e.Until.Format(time.RFC3339))
+}
+
+// checkLoadWindows returns DeferredError when a request is for a target out of its load window.
+// Requests are matched before importing, so no records of a deferred message are imported.
+func checkLoadWindows(reqs []*ImportRequest, now time.Time) error {
+	var deferred *DeferredError
+	for _, req := range reqs {
+		target := req.Target
+		if target.Discard {
+			continue
+		}
+		if next := target.NextLoadTime(now); next.After(now) && (deferred == nil || next.After(deferred.Until)) {
+			deferred = &DeferredError{Target: target, Until: next}
+		}
+	}
+	if deferred != nil {
+		return deferred
+	}
+	return nil
+}
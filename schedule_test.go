@@ -0,0 +1,194 @@
+package rin_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	rin "github.com/fujiwara/Rin"
+	"github.com/fujiwara/Rin/rintest"
+)
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+var cronTests = []struct {
+	expr    string
+	at      time.Time
+	matched bool
+}{
+	{"* * * * *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+	{"*/15 * * * *", time.Date(2024, 1, 1, 0, 45, 0, 0, time.UTC), true},
+	{"*/15 * * * *", time.Date(2024, 1, 1, 0, 46, 0, 0, time.UTC), false},
+	{"5/20 * * * *", time.Date(2024, 1, 1, 0, 45, 0, 0, time.UTC), true},
+	{"0 1-4 * * *", time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC), true},
+	{"0 1-4 * * *", time.Date(2024, 1, 1, 5, 0, 0, 0, time.UTC), false},
+	{"0 1,13 * * *", time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC), true},
+	{"* * * * 7", time.Date(2024, 1, 7, 10, 0, 0, 0, time.UTC), true}, // Sunday
+	{"* * * * 1-5", time.Date(2024, 1, 7, 10, 0, 0, 0, time.UTC), false},
+	{"* * 1 * 0", time.Date(2024, 1, 7, 10, 0, 0, 0, time.UTC), true}, // day of month or day of week
+	{"* * 1 * 0", time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC), false},
+	{"* * 1 6 *", time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), false},
+	{"CRON_TZ=Asia/Tokyo 0 9 * * *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+	{"TZ=UTC 0 9 * * *", time.Date(2024, 1, 1, 9, 0, 0, 0, jst), false},
+}
+
+func TestCron(t *testing.T) {
+	for _, ts := range cronTests {
+		c, err := rin.ParseCron(ts.expr)
+		if err != nil {
+			t.Errorf("failed to parse %s: %s", ts.expr, err)
+			continue
+		}
+		if c.Match(ts.at) != ts.matched {
+			t.Errorf("%s must be %v at %s", ts.expr, ts.matched, ts.at)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"CRON_TZ=Invalid/Zone * * * * *",
+	} {
+		if _, err := rin.ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) must be failed", expr)
+		}
+	}
+}
+
+func TestLoadWindow(t *testing.T) {
+	config, err := rin.LoadConfig(context.Background(), "test/config.schedule.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	always, never, nightly := config.Targets[0], config.Targets[1], config.Targets[2]
+
+	monday := time.Date(2024, 1, 1, 1, 30, 45, 0, jst)
+	if !always.Loadable(monday) || !nightly.Loadable(monday) {
+		t.Error("targets must be loadable in the schedule")
+	}
+	if next := nightly.NextLoadTime(monday); !next.Equal(monday) {
+		t.Errorf("unexpected next load time %s", next)
+	}
+	if next, expected := nightly.NextLoadTime(monday.Add(4*time.Hour)), time.Date(2024, 1, 2, 1, 0, 0, 0, jst); !next.Equal(expected) {
+		t.Errorf("unexpected next load time %s expected %s", next, expected)
+	}
+	sunday := time.Date(2024, 1, 7, 1, 5, 0, 0, jst)
+	if nightly.Loadable(sunday) {
+		t.Error("targets must not be loadable in the blackout")
+	}
+	if next, expected := nightly.NextLoadTime(sunday), time.Date(2024, 1, 7, 1, 10, 0, 0, jst); !next.Equal(expected) {
+		t.Errorf("unexpected next load time %s expected %s", next, expected)
+	}
+	if next := never.NextLoadTime(monday); !next.Equal(monday.Add(rin.MaxLoadWindowSearch)) {
+		t.Errorf("unexpected next load time %s", next)
+	}
+}
+
+func TestDeferVisibility(t *testing.T) {
+	h := newHarness(t, "test/config.schedule.yml")
+	loaded := h.sqs.Send("rin_visibility", s3Event("logs/always/1.json"))
+	deferred := h.sqs.Send("rin_visibility", s3Event("logs/never/1.json"))
+	h.run(t)
+
+	if copies := h.copies(); len(copies) != 1 {
+		t.Errorf("unexpected copies %v", copies)
+	}
+	if d := h.sqs.Deleted("rin_visibility"); len(d) != 1 || d[0] != loaded {
+		t.Errorf("deferred messages must not be deleted %v", d)
+	}
+	if n := count(h.sqs.Requests(), "ChangeMessageVisibility rin_visibility"); n != 1 {
+		t.Errorf("unexpected requests %v", h.sqs.Requests())
+	}
+	// deferred by the limit of the visibility timeout
+	if at := h.sqs.VisibleAt(deferred); time.Until(at) < rin.MaxVisibilityTimeout-time.Minute {
+		t.Errorf("unexpected visible time %s", at)
+	}
+}
+
+func TestDeferRequeue(t *testing.T) {
+	h := newHarness(t, "test/config.schedule.yml")
+	deferred := h.sqs.Send("rin_requeue", s3Event("logs/never/1.json"))
+	h.run(t)
+
+	if copies := h.copies(); len(copies) != 0 {
+		t.Errorf("unexpected copies %v", copies)
+	}
+	if d := h.sqs.Deleted("rin_requeue"); len(d) != 1 || d[0] != deferred {
+		t.Errorf("deferred messages must be deleted after sent again %v", d)
+	}
+	if n := count(h.sqs.Requests(), "SendMessage rin_requeue"); n != 1 {
+		t.Errorf("unexpected requests %v", h.sqs.Requests())
+	}
+	if n := h.sqs.Messages("rin_requeue"); n != 1 {
+		t.Fatalf("deferred messages must be sent again. %d messages", n)
+	}
+	// the message sent again, delayed by the limit of the delay
+	if at := h.sqs.VisibleAt("message-2"); time.Until(at) < rin.MaxDelay-time.Minute {
+		t.Errorf("unexpected visible time %s", at)
+	}
+}
+
+func TestDeferMatchedByAttributes(t *testing.T) {
+	h := newHarness(t, "test/config.schedule.yml")
+	h.s3.Put("test.bucket.test", "logs/mixed/1.json", &rintest.Object{Metadata: map[string]string{"tier": "normal"}})
+	h.s3.Put("test.bucket.test", "logs/mixed/2.json", &rintest.Object{Metadata: map[string]string{"tier": "vip"}})
+	loaded := h.sqs.Send("rin_visibility", s3Event("logs/mixed/1.json"))
+	h.sqs.Send("rin_visibility", s3Event("logs/mixed/2.json"))
+	h.run(t)
+
+	// the target in the blackout doesn't match the first object by its metadata
+	if copies := h.copies(); len(copies) != 1 || !strings.Contains(copies[0], "mixed_log") || !strings.Contains(copies[0], "logs/mixed/1.json") {
+		t.Errorf("unexpected copies %v", copies)
+	}
+	if d := h.sqs.Deleted("rin_visibility"); len(d) != 1 || d[0] != loaded {
+		t.Errorf("unexpected deleted messages %v", d)
+	}
+	if n := count(h.sqs.Requests(), "ChangeMessageVisibility rin_visibility"); n != 1 {
+		t.Errorf("unexpected requests %v", h.sqs.Requests())
+	}
+}
+
+func TestDeferLambda(t *testing.T) {
+	h := newHarness(t, "test/config.schedule.yml")
+	visibility := h.sqs.Send("rin_visibility", s3Event("logs/never/1.json"))
+	requeued := h.sqs.Send("rin_requeue", s3Event("logs/never/1.json"))
+	h.sqs.Send("rin_requeue", s3Event("logs/always/1.json"))
+
+	event := h.sqs.LambdaEvent("rin_visibility", 10)
+	event.Records = append(event.Records, h.sqs.LambdaEvent("rin_requeue", 10).Records...)
+	resp, err := rin.LambdaSQSEventHandler(h.rin, context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lambda deletes records which are not reported, so records deferred by the visibility timeout are reported
+	if f := resp.BatchItemFailures; len(f) != 1 || f[0].ItemIdentifier != visibility {
+		t.Errorf("unexpected batch item failures %v", f)
+	}
+	if n := count(h.sqs.Requests(), "ChangeMessageVisibility rin_visibility"); n != 1 {
+		t.Errorf("unexpected requests %v", h.sqs.Requests())
+	}
+	if at := h.sqs.VisibleAt(visibility); time.Until(at) < rin.MaxVisibilityTimeout-time.Minute {
+		t.Errorf("unexpected visible time %s", at)
+	}
+	if d := h.sqs.Deleted("rin_requeue"); len(d) != 1 || d[0] != requeued {
+		t.Errorf("deferred messages must be deleted after sent again %v", d)
+	}
+	if n := count(h.sqs.Requests(), "SendMessage rin_requeue"); n != 1 {
+		t.Errorf("unexpected requests %v", h.sqs.Requests())
+	}
+	if copies := h.copies(); len(copies) != 1 || !strings.Contains(copies[0], "always_log") {
+		t.Errorf("unexpected copies %v", copies)
+	}
+}
@@ -0,0 +1,334 @@
+package rin
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jackc/pgconn"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	TypePostgresStream = "postgres-stream"
+
+	CopyFromStdinSQLTemplate = "COPY %s FROM STDIN WITH (%s)"
+
+	CompressionAuto = "auto"
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func init() {
+	RegisterImporter(TypePostgresStream, newPostgresStreamImporter)
+}
+
+// Stream represents options of COPY FROM STDIN for postgres-stream targets.
+type Stream struct {
+	Format      string  `yaml:"format"`
+	Header      bool    `yaml:"header"`
+	Delimiter   string  `yaml:"delimiter"`
+	Null        *string `yaml:"null_as"`
+	Quote       string  `yaml:"quote"`
+	Escape      string  `yaml:"escape"`
+	Encoding    string  `yaml:"encoding"`
+	Compression string  `yaml:"compression"`
+}
+
+func (s *Stream) validate() error {
+	switch s.Format {
+	case "csv", "text", "binary":
+	default:
+		return fmt.Errorf("stream.format must be csv, text or binary")
+	}
+	switch s.Compression {
+	case CompressionAuto, CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("stream.compression must be %s, %s, %s or %s", CompressionAuto, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+	if s.Format != "csv" && (s.Header || s.Quote != "" || s.Escape != "") {
+		return fmt.Errorf("stream.header, quote and escape are available only for csv format")
+	}
+	if s.Format == "binary" && (s.Delimiter != "" || s.Null != nil) {
+		return fmt.Errorf("stream.delimiter and null_as are not available for binary format")
+	}
+	for name, v := range map[string]string{"delimiter": s.Delimiter, "quote": s.Quote, "escape": s.Escape} {
+		if len(v) > 1 {
+			return fmt.Errorf("stream.%s must be a single character", name)
+		}
+	}
+	return nil
+}
+
+func (s *Stream) options() string {
+	opts := []string{"FORMAT " + s.Format}
+	if s.Header {
+		opts = append(opts, "HEADER true")
+	}
+	if s.Delimiter != "" {
+		opts = append(opts, "DELIMITER "+quoteValue(s.Delimiter))
+	}
+	if s.Null != nil {
+		opts = append(opts, "NULL "+quoteValue(*s.Null))
+	}
+	if s.Quote != "" {
+		opts = append(opts, "QUOTE "+quoteValue(s.Quote))
+	}
+	if s.Escape != "" {
+		opts = append(opts, "ESCAPE "+quoteValue(s.Escape))
+	}
+	if s.Encoding != "" {
+		opts = append(opts, "ENCODING "+quoteValue(s.Encoding))
+	}
+	return strings.Join(opts, ", ")
+}
+
+// BuildCopyFromStdinSQL builds a COPY FROM STDIN query for postgres-stream targets.
+func (t *Target) BuildCopyFromStdinSQL(record *EventRecord, capture *[]string) (string, error) {
+	table, err := t.tableWithColumns(capture, record.Attributes)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(CopyFromStdinSQLTemplate, table, t.Stream.options()), nil
+}
+
+// DecompressReader returns a reader which decompresses r by the compression.
+// CompressionAuto detects gzip and zstd by the magic number.
+func DecompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	if compression == CompressionAuto {
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(len(zstdMagic))
+		switch {
+		case bytes.HasPrefix(head, gzipMagic):
+			compression = CompressionGzip
+		case bytes.HasPrefix(head, zstdMagic):
+			compression = CompressionZstd
+		default:
+			compression = CompressionNone
+		}
+		r = br
+	}
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case CompressionNone, "":
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %s", compression)
+	}
+}
+
+// postgresStreamImporter downloads S3 objects and streams them into PostgreSQL by COPY FROM STDIN.
+type postgresStreamImporter struct {
+	rin        *Rin
+	connString string
+	conns      chan struct{} // limits open connections by max_open_conns, nil if unlimited
+
+	mu   sync.Mutex
+	idle []*pgconn.PgConn
+}
+
+func newPostgresStreamImporter(r *Rin, target *Target) (Importer, error) {
+	if target.Stream == nil {
+		target.Stream = &Stream{}
+	}
+	s := target.Stream
+	if s.Format == "" {
+		s.Format = "csv"
+	}
+	if s.Compression == "" {
+		s.Compression = CompressionAuto
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	rs := target.Redshift
+	if rs.Host == "" {
+		return nil, fmt.Errorf("redshift.host is required for %s", TypePostgresStream)
+	}
+	i := &postgresStreamImporter{
+		rin:        r,
+		connString: postgresConnString(rs),
+	}
+	if rs.MaxOpenConns > 0 {
+		i.conns = make(chan struct{}, rs.MaxOpenConns)
+	}
+	return i, nil
+}
+
+// postgresConnString returns a connection string. When the password is empty, it is read from PGPASSWORD or .pgpass.
+// When the port is not set, it is read from PGPORT or defaults to 5432.
+func postgresConnString(rs *Redshift) string {
+	u := &url.URL{
+		Scheme: "postgres",
+		Host:   rs.Host,
+		Path:   "/" + rs.DBName,
+	}
+	if rs.Port != 0 {
+		u.Host = net.JoinHostPort(rs.Host, strconv.Itoa(rs.Port))
+	}
+	if rs.Password != "" {
+		u.User = url.UserPassword(rs.User, rs.Password)
+	} else {
+		u.User = url.User(rs.User)
+	}
+	return u.String()
+}
+
+// acquire returns an idle connection or a new one. It waits while max_open_conns connections are in use.
+// A new connection is opened only when no connections are idle, so connections in use and idle never exceed the limit.
+func (i *postgresStreamImporter) acquire(ctx context.Context) (*pgconn.PgConn, error) {
+	if i.conns != nil {
+		if err := acquire(ctx, i.conns); err != nil {
+			return nil, err
+		}
+	}
+	i.mu.Lock()
+	for len(i.idle) > 0 {
+		conn := i.idle[len(i.idle)-1]
+		i.idle = i.idle[:len(i.idle)-1]
+		if !conn.IsClosed() {
+			i.mu.Unlock()
+			return conn, nil
+		}
+	}
+	i.mu.Unlock()
+	conn, err := pgconn.Connect(ctx, i.connString)
+	if err != nil {
+		i.releaseSlot()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (i *postgresStreamImporter) releaseSlot() {
+	if i.conns != nil {
+		<-i.conns
+	}
+}
+
+// release returns the connection to the pool. The connection is closed on error because its state is unknown.
+func (i *postgresStreamImporter) release(conn *pgconn.PgConn, err error) {
+	defer i.releaseSlot()
+	if err != nil || conn.IsClosed() {
+		conn.Close(context.Background())
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.idle = append(i.idle, conn)
+}
+
+func (i *postgresStreamImporter) Import(ctx context.Context, req *ImportRequest) error {
+	target, record := req.Target, req.Record
+	i.rin.logger.Printf("[info] Import to target %s from record %s", target, record)
+	query, err := target.BuildCopyFromStdinSQL(record, req.Capture)
+	if err != nil {
+		return err
+	}
+	table, err := target.tableName(req.Capture, record.Attributes)
+	if err != nil {
+		return err
+	}
+	unlock, err := i.rin.throttle.acquire(ctx, target, table)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	bucket, key := record.S3.Bucket.Name, record.S3.Object.Key
+	obj, err := i.rin.getS3Client().GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, func(o *s3.Options) {
+		if target.S3.Region != "" {
+			o.Region = target.S3.Region
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get object s3://%s/%s, %w", bucket, key, err)
+	}
+	defer obj.Body.Close()
+	body, err := DecompressReader(obj.Body, target.Stream.Compression)
+	if err != nil {
+		return fmt.Errorf("failed to decompress s3://%s/%s, %w", bucket, key, err)
+	}
+	defer body.Close()
+
+	conn, err := i.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	i.rin.logger.Println("[debug] SQL:", query)
+	tag, err := conn.CopyFrom(ctx, body, query)
+	i.release(conn, err)
+	if err != nil {
+		return err
+	}
+	i.rin.logger.Printf("[info] [%s] %d rows copied from s3://%s/%s", req.MessageID, tag.RowsAffected(), bucket, key)
+	req.Report(tag.RowsAffected(), query)
+	return target.CheckLoadedRows(tag.RowsAffected())
+}
+
+func (i *postgresStreamImporter) Remove(ctx context.Context, req *ImportRequest) error {
+	i.rin.logger.Printf("[info] Delete from target %s by record %s", req.Target, req.Record)
+	query, err := req.Target.BuildDeleteSQL(req.Capture)
+	if err != nil {
+		return err
+	}
+	table, err := req.Target.tableName(req.Capture, req.Record.Attributes)
+	if err != nil {
+		return err
+	}
+	unlock, err := i.rin.throttle.acquire(ctx, req.Target, table)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conn, err := i.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	i.rin.logger.Println("[debug] SQL:", query)
+	// ExecParams uses the extended query protocol, which rejects multiple statements in a query
+	err = conn.ExecParams(ctx, query, nil, nil, nil, nil).Read().Err
+	i.release(conn, err)
+	if err != nil {
+		return err
+	}
+	req.Report(-1, query)
+	return nil
+}
+
+// Close closes idle connections.
+func (i *postgresStreamImporter) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, conn := range i.idle {
+		conn.Close(context.Background())
+	}
+	i.idle = nil
+	return nil
+}
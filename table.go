@@ -0,0 +1,271 @@
+package rin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lib/pq"
+)
+
+const (
+	CreateTableSQLTemplate = "/* Rin */ CREATE TABLE IF NOT EXISTS %s (%s)"
+
+	InferJSON = "json"
+	InferCSV  = "csv"
+)
+
+// DefaultInferredColumnType is the type of inferred columns which types can't be detected, and of all CSV columns.
+var DefaultInferredColumnType = "VARCHAR(65535)"
+
+// CreateTable represents how to create the table of a target before the first COPY.
+// ddl is a template of CREATE TABLE, or infer reads columns from the first object.
+type CreateTable struct {
+	DDL         string `yaml:"ddl"`
+	Infer       string `yaml:"infer"`
+	Delimiter   string `yaml:"delimiter"`
+	Compression string `yaml:"compression"`
+}
+
+func (c *CreateTable) setup() error {
+	if c == nil {
+		return nil
+	}
+	if (c.DDL == "") == (c.Infer == "") {
+		return fmt.Errorf("target.create_table requires either ddl or infer")
+	}
+	if ddlPlaceHolder.MatchString(c.DDL) {
+		return fmt.Errorf("target.create_table.ddl can contain only ${table}, because captured values and attributes are not quoted")
+	}
+	switch c.Infer {
+	case "", InferJSON:
+	case InferCSV:
+		if c.Delimiter == "" {
+			c.Delimiter = ","
+		}
+		if len([]rune(c.Delimiter)) != 1 {
+			return fmt.Errorf("target.create_table.delimiter must be a single character")
+		}
+	default:
+		return fmt.Errorf("target.create_table.infer must be %s or %s", InferJSON, InferCSV)
+	}
+	if c.Compression == "" {
+		c.Compression = CompressionAuto
+	}
+	switch c.Compression {
+	case CompressionAuto, CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("target.create_table.compression must be %s, %s, %s or %s", CompressionAuto, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+	return nil
+}
+
+// ddlPlaceHolder matches captured values and attributes, which are not allowed in ddl.
+var ddlPlaceHolder = regexp.MustCompile(`\$[0-9]|\$\{(metadata|tag):`)
+
+// BuildCreateTableSQL expands ${table} in the ddl template to the quoted table name of the record.
+func (t *Target) BuildCreateTableSQL(record *EventRecord, capture *[]string) (string, error) {
+	table, err := t.tableName(capture, record.Attributes)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(t.CreateTable.DDL, "${table}", table, -1), nil
+}
+
+// InferColumns returns column definitions read from the first JSON object or the CSV header.
+func InferColumns(r io.Reader, infer string, delimiter string) ([]string, error) {
+	switch infer {
+	case InferJSON:
+		return inferJSONColumns(r)
+	case InferCSV:
+		cr := csv.NewReader(r)
+		cr.Comma = []rune(delimiter)[0]
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV header, %w", err)
+		}
+		cols := newInferredColumns()
+		for _, name := range header {
+			if err := cols.add(name, DefaultInferredColumnType); err != nil {
+				return nil, err
+			}
+		}
+		return cols.defs, nil
+	}
+	return nil, fmt.Errorf("unknown infer %s", infer)
+}
+
+// inferJSONColumns reads keys of the first JSON object in order.
+func inferJSONColumns(r io.Reader) ([]string, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("failed to read JSON, %w", err)
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("the first JSON value must be an object")
+	}
+	cols := newInferredColumns()
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JSON, %w", err)
+		}
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("failed to read JSON, %w", err)
+		}
+		if err := cols.add(tok.(string), DefaultJSONColumnTypes[jsonKind(v)]); err != nil {
+			return nil, err
+		}
+	}
+	if len(cols.defs) == 0 {
+		return nil, fmt.Errorf("the first JSON object has no keys")
+	}
+	return cols.defs, nil
+}
+
+// DefaultJSONColumnTypes maps kinds of JSON values to column types. Kinds are boolean, integer, number and string.
+// null, objects and arrays are string.
+var DefaultJSONColumnTypes = map[string]string{
+	"boolean": "BOOLEAN",
+	"integer": "BIGINT",
+	"number":  "DOUBLE PRECISION",
+	"string":  DefaultInferredColumnType,
+}
+
+func jsonKind(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return "string"
+}
+
+// inferredColumns holds column definitions in order. Names which are the same in lower case are rejected.
+type inferredColumns struct {
+	defs  []string
+	names map[string]string
+}
+
+func newInferredColumns() *inferredColumns {
+	return &inferredColumns{names: make(map[string]string)}
+}
+
+func (c *inferredColumns) add(name, typ string) error {
+	// JSON 'auto' of COPY matches keys to lower case column names
+	col := strings.ToLower(strings.TrimSpace(name))
+	if prev, ok := c.names[col]; ok {
+		return fmt.Errorf("%q and %q are the same column %s in lower case", prev, name, col)
+	}
+	c.names[col] = name
+	c.defs = append(c.defs, pq.QuoteIdentifier(col)+" "+typ)
+	return nil
+}
+
+// tableCache holds tables which exist, by the identity of the connection and the table name.
+type tableCache struct {
+	mu     sync.Mutex
+	tables map[string]bool
+}
+
+func (c *tableCache) exists(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tables[key]
+}
+
+func (c *tableCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tables == nil {
+		c.tables = make(map[string]bool)
+	}
+	c.tables[key] = true
+}
+
+// createTable runs CREATE TABLE IF NOT EXISTS for the table of the request once per instance.
+func (r *Rin) createTable(ctx context.Context, req *ImportRequest, table string) error {
+	target := req.Target
+	key := target.Redshift.VisibleDSN() + "/" + table
+	if r.tables.exists(key) {
+		return nil
+	}
+	var query string
+	if target.CreateTable.DDL != "" {
+		var err error
+		if query, err = target.BuildCreateTableSQL(req.Record, req.Capture); err != nil {
+			return err
+		}
+	} else {
+		cols, err := r.inferColumns(ctx, req)
+		if err != nil {
+			return err
+		}
+		query = fmt.Sprintf(CreateTableSQLTemplate, table, strings.Join(cols, ", "))
+	}
+	r.logger.Printf("[info] [%s] Create table %s if not exists", req.MessageID, table)
+	if _, err := r.execRedshift(ctx, target, "", []string{query}, -1); err != nil {
+		return fmt.Errorf("failed to create table %s, %w", table, err)
+	}
+	r.tables.add(key)
+	return nil
+}
+
+func (r *Rin) inferColumns(ctx context.Context, req *ImportRequest) ([]string, error) {
+	c := req.Target.CreateTable
+	body, err := r.openObject(ctx, req, c.Compression)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	cols, err := InferColumns(body, c.Infer, c.Delimiter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to infer columns from %s, %w", req.Record, err)
+	}
+	return cols, nil
+}
+
+// openObject returns the decompressed body of the object of the request.
+func (r *Rin) openObject(ctx context.Context, req *ImportRequest, compression string) (io.ReadCloser, error) {
+	bucket, key := req.Record.S3.Bucket.Name, req.Record.S3.Object.Key
+	obj, err := r.getS3Client().GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, func(o *s3.Options) {
+		if req.Target.S3.Region != "" {
+			o.Region = req.Target.S3.Region
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object s3://%s/%s, %w", bucket, key, err)
+	}
+	body, err := DecompressReader(obj.Body, compression)
+	if err != nil {
+		obj.Body.Close()
+		return nil, fmt.Errorf("failed to decompress s3://%s/%s, %w", bucket, key, err)
+	}
+	return &objectReader{ReadCloser: body, body: obj.Body}, nil
+}
+
+// objectReader closes the decompressor and the body of the object.
+type objectReader struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (o *objectReader) Close() error {
+	o.ReadCloser.Close()
+	return o.body.Close()
+}
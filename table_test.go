@@ -0,0 +1,63 @@
+package rin_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestCreateTable(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFinished, rows: 1}
+	r, rec := newS3TestInstance(t, "test/config.create_table.yml", &memoryImporter{}, rin.WithRedshiftDataClient(f))
+	rec.objects = map[string]string{
+		"/test.bucket.test/json/foo/1.json": `{"id": 1, "Name": "x", "score": 1.5, "ok": true, "tags": [1]}` + "\n" + `{"id": 2}`,
+		"/test.bucket.test/csv/bar/1.csv":   "id|Name\n1|x\n",
+	}
+
+	event, _ := rin.ParseEvent([]byte(`{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"ddl/app/events/1.json","size":10}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"ddl/app/events/2.json","size":10}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"json/foo/1.json","size":10}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"test.bucket.test"},"object":{"key":"csv/bar/1.csv","size":10}}}
+	]}`))
+	if _, err := r.Import(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	var executed []string
+	for _, stmts := range f.executed {
+		executed = append(executed, strings.Join(stmts, "; "))
+	}
+	if len(executed) != 7 {
+		t.Fatalf("unexpected executed %v", executed)
+	}
+	expected := map[int]string{
+		0: `CREATE TABLE IF NOT EXISTS "app"."events" (id BIGINT, name VARCHAR(256), app VARCHAR(16) DEFAULT 'rin')`,
+		3: `/* Rin */ CREATE TABLE IF NOT EXISTS "foo" ("id" BIGINT, "name" VARCHAR(65535), "score" DOUBLE PRECISION, "ok" BOOLEAN, "tags" VARCHAR(65535))`,
+		5: `/* Rin */ CREATE TABLE IF NOT EXISTS "bar" ("id" VARCHAR(65535), "name" VARCHAR(65535))`,
+	}
+	for i, s := range executed {
+		if e, ok := expected[i]; ok {
+			if s != e {
+				t.Errorf("unexpected statement %d %s", i, s)
+			}
+		} else if !strings.HasPrefix(s, "/* Rin */ COPY") {
+			// the table is created once
+			t.Errorf("statement %d must be COPY %s", i, s)
+		}
+	}
+}
+
+func TestInferColumnsError(t *testing.T) {
+	for _, body := range []string{``, `[1, 2]`, `{}`, `{"ID": 1, "id": 2}`} {
+		if cols, err := rin.InferColumns(strings.NewReader(body), rin.InferJSON, ""); err == nil {
+			t.Errorf("InferColumns must be failed for %q %v", body, cols)
+		}
+	}
+	if cols, err := rin.InferColumns(strings.NewReader("id,Name,name\n"), rin.InferCSV, ","); err == nil {
+		t.Errorf("InferColumns must be failed for duplicated CSV columns %v", cols)
+	}
+}
@@ -0,0 +1,140 @@
+package rin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttle limits COPY queries by the number of concurrent queries per DSN, the rate per target and the lock per table.
+type throttle struct {
+	mu         sync.Mutex
+	semaphores map[string]chan struct{}
+	tableLocks map[string]chan struct{}
+	limiters   map[*Target]*rate.Limiter
+
+	// now and sleep wait for the rate limit. They are replaced in tests.
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newThrottle() *throttle {
+	return &throttle{
+		semaphores: make(map[string]chan struct{}),
+		tableLocks: make(map[string]chan struct{}),
+		limiters:   make(map[*Target]*rate.Limiter),
+		now:        time.Now,
+		sleep:      sleepContext,
+	}
+}
+
+func (t *throttle) semaphore(key string, size int) chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.semaphores[key]
+	if s == nil {
+		s = make(chan struct{}, size)
+		t.semaphores[key] = s
+	}
+	return s
+}
+
+func (t *throttle) tableLock(key string) chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.tableLocks[key]
+	if l == nil {
+		l = make(chan struct{}, 1)
+		t.tableLocks[key] = l
+	}
+	return l
+}
+
+func (t *throttle) limiter(target *Target) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.limiters[target]
+	if l == nil {
+		burst := target.RateBurst
+		if burst == 0 {
+			burst = 1
+		}
+		l = rate.NewLimiter(rate.Limit(target.RateLimit), burst)
+		t.limiters[target] = l
+	}
+	return l
+}
+
+// wait reserves a token of the limiter, and sleeps until the token is available.
+func (t *throttle) wait(ctx context.Context, l *rate.Limiter) error {
+	r := l.ReserveN(t.now(), 1)
+	if !r.OK() {
+		return fmt.Errorf("rate limit can't be satisfied with burst %d", l.Burst())
+	}
+	if err := t.sleep(ctx, r.DelayFrom(t.now())); err != nil {
+		// return the token not to delay others
+		r.CancelAt(t.now())
+		return err
+	}
+	return nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func acquire(ctx context.Context, ch chan struct{}) error {
+	select {
+	case ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquire waits for the rate limit of the target, the lock of the table and the semaphore of the DSN.
+// The returned function releases them.
+func (t *throttle) acquire(ctx context.Context, target *Target, table string) (func(), error) {
+	rs := target.Redshift
+	if target.RateLimit > 0 {
+		if err := t.wait(ctx, t.limiter(target)); err != nil {
+			return nil, err
+		}
+	}
+	var held []chan struct{}
+	release := func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			<-held[i]
+		}
+	}
+	// wait for the table lock before the semaphore, not to occupy a slot of the DSN while waiting
+	if BoolValue(rs.LockTable) {
+		l := t.tableLock(rs.VisibleDSN() + "/" + table)
+		if err := acquire(ctx, l); err != nil {
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	if rs.MaxConcurrentCopies > 0 {
+		s := t.semaphore(rs.VisibleDSN(), rs.MaxConcurrentCopies)
+		if err := acquire(ctx, s); err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, s)
+	}
+	return release, nil
+}
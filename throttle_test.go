@@ -0,0 +1,92 @@
+package rin_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/redshiftdata/types"
+
+	rin "github.com/fujiwara/Rin"
+)
+
+func TestMaxConcurrentCopies(t *testing.T) {
+	f := &fakeRedshiftData{polls: 3, status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.throttle.yml", rin.WithRedshiftDataClient(f))
+	importKeys(t, r, []string{
+		"throttle/t1/1.json", "throttle/t2/1.json", "throttle/t3/1.json",
+		"throttle/t4/1.json", "throttle/t5/1.json", "throttle/t6/1.json",
+	})
+	if len(f.executed) != 6 {
+		t.Errorf("unexpected executed %d", len(f.executed))
+	}
+	if f.maxRunning != 2 {
+		t.Errorf("max concurrent copies must be 2, got %d", f.maxRunning)
+	}
+}
+
+func TestLockTable(t *testing.T) {
+	f := &fakeRedshiftData{polls: 3, status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.throttle.yml", rin.WithRedshiftDataClient(f))
+	importKeys(t, r, []string{"throttle/same/1.json", "throttle/same/2.json", "throttle/same/3.json"})
+	if len(f.executed) != 3 {
+		t.Errorf("unexpected executed %d", len(f.executed))
+	}
+	if f.maxRunning != 1 {
+		t.Errorf("copies into the same table must not run concurrently, got %d", f.maxRunning)
+	}
+}
+
+func TestLockTableOnRemove(t *testing.T) {
+	f := &fakeRedshiftData{polls: 3, status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.throttle.yml", rin.WithRedshiftDataClient(f))
+	sendEvents(t, r, "ObjectRemoved:Delete", []string{"removed/1.json", "removed/2.json", "removed/3.json"})
+	if len(f.executed) != 3 {
+		t.Errorf("unexpected executed %d", len(f.executed))
+	}
+	if f.maxRunning != 1 {
+		t.Errorf("deletes from the same table must not run concurrently, got %d", f.maxRunning)
+	}
+}
+
+func TestLockTableCreate(t *testing.T) {
+	f := &fakeRedshiftData{polls: 3, status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.throttle.yml", rin.WithRedshiftDataClient(f))
+	importKeys(t, r, []string{"created/1.json", "created/2.json", "created/3.json"})
+	var creates int
+	for _, stmts := range f.executed {
+		if strings.HasPrefix(stmts[0], "CREATE TABLE") {
+			creates++
+		}
+	}
+	// the table is created in the lock, so the others find it in the cache
+	if creates != 1 {
+		t.Errorf("the table must be created once, created %d times %v", creates, f.executed)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	f := &fakeRedshiftData{status: types.StatusStringFinished}
+	r := newTestInstance(t, "test/config.throttle.yml", rin.WithRedshiftDataClient(f))
+	// all copies are reserved at the same time, and their delays are recorded instead of sleeping
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	var delays []time.Duration
+	rin.SetThrottleClock(r, func() time.Time { return now }, func(_ context.Context, d time.Duration) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delays = append(delays, d)
+		return nil
+	})
+	importKeys(t, r, []string{"rated/1.json", "rated/2.json", "rated/3.json"})
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	// 20/s with burst 1: the copies start at 0ms, 50ms and 100ms
+	expected := []time.Duration{0, 50 * time.Millisecond, 100 * time.Millisecond}
+	if fmt.Sprint(delays) != fmt.Sprint(expected) {
+		t.Errorf("copies must be rate limited, delays %v", delays)
+	}
+}
@@ -0,0 +1,132 @@
+package rin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ValidateTimeout is the timeout to get columns of a table for validation.
+var ValidateTimeout = 30 * time.Second
+
+var templatePlaceHolder = regexp.MustCompile(`\$(\d|\{)`)
+
+// Validate loads the configuration and validates it by the table definitions of the database.
+func Validate(configFile string, opt *Option) error {
+	ctx := context.Background()
+	log.Println("[info] Loading config:", configFile)
+	config, err := LoadConfig(ctx, configFile)
+	if err != nil {
+		return err
+	}
+	r, err := New(config,
+		WithSessions(Sessions),
+		WithOption(opt),
+	)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.logTargets()
+	return r.Validate(ctx)
+}
+
+// Validate validates columns of targets by the table definitions in svv_columns.
+// Targets whose table or columns are templated are not validated, and columns are not validated when the database is not reachable.
+// Other errors make the targets invalid.
+func (r *Rin) Validate(ctx context.Context) error {
+	var invalid []string
+	for _, t := range r.allTargets() {
+		if t.Discard || t.Type != TypeRedshift || len(t.Columns) == 0 {
+			continue
+		}
+		if t.isTemplatedTable() {
+			r.logger.Printf("[info] Skip validating columns of %s, because the table or columns are templated", t)
+			continue
+		}
+		if err := r.validateColumns(ctx, t); err != nil {
+			if isUnreachable(err) {
+				r.logger.Printf("[warn] Can't validate columns of %s, because the database is not reachable. %s", t, err)
+				continue
+			}
+			r.logger.Printf("[error] Target %s is invalid. %s", t, err)
+			invalid = append(invalid, err.Error())
+			continue
+		}
+		r.logger.Printf("[info] Columns of %s are valid", t)
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%d targets are invalid: %s", len(invalid), strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// isUnreachable reports whether err is caused by the network or the timeout.
+func isUnreachable(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type missingColumnsError struct {
+	table   string
+	columns []string
+}
+
+func (e *missingColumnsError) Error() string {
+	return fmt.Sprintf("columns %s are not found in %s", strings.Join(e.columns, ", "), e.table)
+}
+
+func (r *Rin) validateColumns(ctx context.Context, t *Target) error {
+	ctx, cancel := context.WithTimeout(ctx, ValidateTimeout)
+	defer cancel()
+	schema, table, err := t.expandTable(&[]string{}, nil)
+	if err != nil {
+		return err
+	}
+	cols, err := r.tableColumns(ctx, t, schema, table)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, c := range t.Columns {
+		if !cols[strings.ToLower(c)] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return &missingColumnsError{table: t.Redshift.TableString(), columns: missing}
+	}
+	return nil
+}
+
+func (t *Target) isTemplatedTable() bool {
+	for _, s := range append([]string{t.Redshift.Schema, t.Redshift.Table}, t.Columns...) {
+		if templatePlaceHolder.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// allTargets returns targets of the configuration and the queues without duplicates.
+func (r *Rin) allTargets() []*Target {
+	targets := append([]*Target{}, r.config.Targets...)
+	seen := make(map[*Target]bool, len(targets))
+	for _, t := range targets {
+		seen[t] = true
+	}
+	for _, q := range r.config.Queues {
+		for _, t := range q.Targets {
+			if !seen[t] {
+				seen[t] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}